@@ -0,0 +1,206 @@
+/*
+Copyright 2019 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+
+	"github.com/gravitational/teleport/lib/services"
+
+	"github.com/gravitational/trace"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/sha3"
+)
+
+// pbkdf2Iterations is the number of PBKDF2 rounds used to derive the
+// AES-256-GCM key that wraps CA signing keys at rest. This intentionally
+// mirrors the cost SwarmKit uses for its manager CA key encryption.
+const pbkdf2Iterations = 100000
+
+// pbkdf2SaltLen is the length, in bytes, of the random salt stored
+// alongside each wrapped key.
+const pbkdf2SaltLen = 16
+
+// KeyWrapper wraps and unwraps CA signing keys with an administrator
+// supplied unlock key before they are persisted to the backend. When
+// InitConfig.KeyWrapper is unset, CA keys are stored in plaintext as
+// before.
+type KeyWrapper interface {
+	// Wrap encrypts plaintext PEM-encoded key material and returns an
+	// opaque blob safe to persist in CertAuthoritySpecV2.
+	Wrap(plaintext []byte) ([]byte, error)
+	// Unwrap decrypts a blob previously returned by Wrap.
+	Unwrap(ciphertext []byte) ([]byte, error)
+}
+
+// passphraseKeyWrapper is a KeyWrapper that derives an AES-256-GCM key
+// from an administrator supplied unlock passphrase using PBKDF2, and
+// uses PKCS#8 PBES2 style framing (salt || nonce || ciphertext).
+type passphraseKeyWrapper struct {
+	unlockKey []byte
+}
+
+// NewPassphraseKeyWrapper returns a KeyWrapper that protects CA signing
+// keys with the given cluster unlock passphrase. It is the default
+// implementation used when InitConfig.UnlockKey is set.
+func NewPassphraseKeyWrapper(unlockKey []byte) (KeyWrapper, error) {
+	if len(unlockKey) == 0 {
+		return nil, trace.BadParameter("UnlockKey: unlock key can not be empty")
+	}
+	return &passphraseKeyWrapper{unlockKey: unlockKey}, nil
+}
+
+// Wrap implements KeyWrapper.
+func (p *passphraseKeyWrapper) Wrap(plaintext []byte) ([]byte, error) {
+	salt := make([]byte, pbkdf2SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	gcm, err := p.newGCM(salt)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	sealed := gcm.Seal(nil, nonce, plaintext, nil)
+	out := make([]byte, 0, len(salt)+len(nonce)+len(sealed))
+	out = append(out, salt...)
+	out = append(out, nonce...)
+	out = append(out, sealed...)
+	return out, nil
+}
+
+// Unwrap implements KeyWrapper.
+func (p *passphraseKeyWrapper) Unwrap(ciphertext []byte) ([]byte, error) {
+	if len(ciphertext) < pbkdf2SaltLen {
+		return nil, trace.BadParameter("ciphertext too short to contain salt")
+	}
+	salt := ciphertext[:pbkdf2SaltLen]
+	gcm, err := p.newGCM(salt)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	nonceSize := gcm.NonceSize()
+	rest := ciphertext[pbkdf2SaltLen:]
+	if len(rest) < nonceSize {
+		return nil, trace.BadParameter("ciphertext too short to contain nonce")
+	}
+	nonce, sealed := rest[:nonceSize], rest[nonceSize:]
+	plaintext, err := gcm.Open(nil, nonce, sealed, nil)
+	if err != nil {
+		return nil, trace.AccessDenied("failed to unwrap key, incorrect unlock key?")
+	}
+	return plaintext, nil
+}
+
+func (p *passphraseKeyWrapper) newGCM(salt []byte) (cipher.AEAD, error) {
+	key := pbkdf2.Key(p.unlockKey, salt, pbkdf2Iterations, 32, sha3.New256)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return gcm, nil
+}
+
+// wrapSigningKeys wraps every signing key in keys with w, leaving an
+// already-configured nil KeyWrapper as a passthrough.
+func wrapSigningKeys(w KeyWrapper, keys [][]byte) ([][]byte, error) {
+	if w == nil {
+		return keys, nil
+	}
+	wrapped := make([][]byte, len(keys))
+	for i, key := range keys {
+		out, err := w.Wrap(key)
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+		wrapped[i] = out
+	}
+	return wrapped, nil
+}
+
+// rewrapLegacyCAKeys wraps any user/host CA signing keys and TLS keys
+// left over from before an unlock key was configured on this cluster.
+// Keys that already decrypt successfully under w are assumed to be
+// wrapped already and are left untouched.
+func rewrapLegacyCAKeys(asrv *AuthServer, w KeyWrapper) error {
+	clusterName, err := asrv.GetClusterName()
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	for _, caType := range []services.CertAuthType{services.UserCA, services.HostCA} {
+		ca, err := asrv.GetCertAuthority(services.CertAuthID{
+			DomainName: clusterName.GetClusterName(),
+			Type:       caType,
+		}, true)
+		if err != nil {
+			if trace.IsNotFound(err) {
+				continue
+			}
+			return trace.Wrap(err)
+		}
+		changed := false
+
+		signingKeys := ca.GetSigningKeys()
+		if len(signingKeys) != 0 {
+			if _, err := w.Unwrap(signingKeys[0]); err != nil {
+				// not yet wrapped with the current unlock key
+				log.Infof("Migrate: wrapping plaintext %v signing keys with cluster unlock key.", caType)
+				wrapped, err := wrapSigningKeys(w, signingKeys)
+				if err != nil {
+					return trace.Wrap(err)
+				}
+				ca.SetSigningKeys(wrapped)
+				changed = true
+			}
+		}
+
+		tlsKeyPairs := ca.GetTLSKeyPairs()
+		if len(tlsKeyPairs) != 0 {
+			if _, err := w.Unwrap(tlsKeyPairs[0].Key); err != nil {
+				// not yet wrapped with the current unlock key
+				log.Infof("Migrate: wrapping plaintext %v TLS key with cluster unlock key.", caType)
+				rewrapped := make([]services.TLSKeyPair, len(tlsKeyPairs))
+				for i, pair := range tlsKeyPairs {
+					wrapped, err := wrapSigningKeys(w, [][]byte{pair.Key})
+					if err != nil {
+						return trace.Wrap(err)
+					}
+					rewrapped[i] = services.TLSKeyPair{Cert: pair.Cert, Key: wrapped[0]}
+				}
+				ca.SetTLSKeyPairs(rewrapped)
+				changed = true
+			}
+		}
+
+		if !changed {
+			continue
+		}
+		if err := asrv.Trust.UpsertCertAuthority(ca); err != nil {
+			return trace.Wrap(err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+/*
+Copyright 2019 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gravitational/teleport"
+
+	"github.com/gravitational/trace"
+)
+
+// pendingIdentitySubdir holds not-yet-promoted host certificates
+// generated by RequestPendingHostCert, one level below the process's
+// usual identity storage. Keeping pending material in its own directory
+// means a crash mid-rotation can never clobber the identity a node is
+// currently using to connect to the cluster.
+const pendingIdentitySubdir = "pending"
+
+// RequestPendingHostCert generates a fresh keypair, requests a new
+// SSH+TLS host certificate from asrv for id, and writes it to the
+// pending identity slot without touching the identity currently in use.
+// It does not promote the new certificate; call PromotePendingHostCert
+// once the owning process has verified it can load and use it. Passing
+// unlockKey encrypts the pending private key at rest exactly as any
+// other host identity (see WriteJoinedIdentity); it should be the same
+// unlock key the process's current identity was written with.
+func RequestPendingHostCert(asrv *AuthServer, dataDir string, id IdentityID, additionalPrincipals []string, unlockKey []byte) (*Identity, error) {
+	if asrv.IsSealed() {
+		return nil, trace.AccessDenied("auth server is sealed; an administrator must call Unlock before it will sign certificates")
+	}
+	identity, err := GenerateIdentity(asrv, id, additionalPrincipals)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	if err := writePendingIdentity(dataDir, id, identity, unlockKey); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	log.Infof("Rotation: wrote pending host certificate for %v.", id)
+	return identity, nil
+}
+
+// PromotePendingHostCert atomically replaces the current identity for id
+// with the previously requested pending one. It should only be called
+// after the caller has itself successfully loaded and exercised the
+// pending identity (e.g. dialed the auth server with it), guaranteeing a
+// bad rotation can never brick a node's ability to reconnect. unlockKey
+// must match the one RequestPendingHostCert was called with, or the
+// promoted identity will be unreadable on the next process restart.
+func PromotePendingHostCert(dataDir string, id IdentityID, unlockKey []byte) error {
+	pending, err := readPendingIdentity(dataDir, id, unlockKey)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	if err := WriteLocalIdentity(dataDir, *pending, unlockKey); err != nil {
+		return trace.Wrap(err)
+	}
+	if err := deletePendingIdentity(dataDir, id); err != nil {
+		if !trace.IsNotFound(err) {
+			return trace.Wrap(err)
+		}
+	}
+	log.Infof("Rotation: promoted pending host certificate for %v to current.", id)
+	return nil
+}
+
+// HasPendingHostCert returns true if id has a pending certificate
+// awaiting promotion.
+func HasPendingHostCert(dataDir string, id IdentityID) bool {
+	_, err := os.Stat(pendingIdentityDir(dataDir, id))
+	return err == nil
+}
+
+func pendingIdentityDir(dataDir string, id IdentityID) string {
+	return filepath.Join(dataDir, pendingIdentitySubdir, strings.ToLower(id.Roles.String()))
+}
+
+func writePendingIdentity(dataDir string, id IdentityID, identity *Identity, unlockKey []byte) error {
+	dir := pendingIdentityDir(dataDir, id)
+	if err := os.MkdirAll(dir, teleportFileMode); err != nil {
+		return trace.ConvertSystemError(err)
+	}
+	return WriteLocalIdentity(dir, *identity, unlockKey)
+}
+
+func readPendingIdentity(dataDir string, id IdentityID, unlockKey []byte) (*Identity, error) {
+	return ReadLocalIdentityWithUnlockKey(pendingIdentityDir(dataDir, id), id, unlockKey)
+}
+
+func deletePendingIdentity(dataDir string, id IdentityID) error {
+	return trace.ConvertSystemError(os.RemoveAll(pendingIdentityDir(dataDir, id)))
+}
+
+// teleportFileMode is the permission bits used for the directories
+// created to hold pending identity material, matching the private,
+// owner-only convention Teleport uses for its data directory.
+const teleportFileMode = 0700
+
+// RotateAllHostCerts is intended to drive every node currently
+// registered with asrv through a rotation handshake for role: asking
+// each node (via its heartbeat/reverse-tunnel connection) to call
+// RequestPendingHostCert, confirm it can use the new certificate, and
+// then PromotePendingHostCert. Unlike RotateCertAuthority's cluster-wide
+// phase gate, each node would transition independently, so a single
+// unreachable node could not block the rest of the fleet from rotating.
+//
+// That delivery channel does not exist in this tree: there is no
+// inventory control stream or other connection from the auth server
+// back to an already-joined node's process to carry the request over.
+// Returning nil
+// here would make this RPC a silent no-op that callers can't
+// distinguish from "every node rotated"; fail loudly instead until the
+// delivery mechanism is built.
+func (a *AuthServer) RotateAllHostCerts(role teleport.Role) error {
+	return trace.NotImplemented("RotateAllHostCerts requires a node delivery channel (e.g. an inventory control stream) that does not exist yet; rotate hosts individually with RequestPendingHostCert/PromotePendingHostCert")
+}
@@ -0,0 +1,129 @@
+/*
+Copyright 2019 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"context"
+
+	"github.com/gravitational/teleport"
+
+	"github.com/gravitational/trace"
+)
+
+// IdentityStoreConfig selects and configures where a process's host
+// identity private keys actually live, mirroring the "storage:" section
+// of teleport.yaml, e.g.:
+//
+//	storage:
+//	  type: pkcs11
+//	  module: /usr/lib/softhsm/libsofthsm2.so
+//	  slot: 0
+type IdentityStoreConfig struct {
+	// Type selects the backend: "file" (default), "pkcs11", "awskms", or
+	// "gcpkms".
+	Type string
+	// DataDir is used by the file backend, and as the on-disk location
+	// for the (encrypted) key material managed by the KMS backends.
+	DataDir string
+	// PKCS11 configures the PKCS#11 backend. Only used when Type is
+	// "pkcs11".
+	PKCS11 PKCS11Config
+	// KMSKeyID identifies the CMK used to envelope-encrypt on-disk key
+	// material. Only used when Type is "awskms" or "gcpkms".
+	KMSKeyID string
+}
+
+// IdentityStore is where a process's host identity (private key, certs)
+// is actually persisted between restarts. The default file-backed
+// implementation keeps today's behavior; the PKCS#11 and KMS-backed
+// implementations exist for FIPS/compliance deployments where private
+// key material must never touch disk in cleartext.
+type IdentityStore interface {
+	// Read loads the identity for id, or a NotFound error if none has
+	// been written yet.
+	Read(id IdentityID) (*Identity, error)
+	// Write persists identity under id, replacing whatever was there.
+	Write(id IdentityID, identity *Identity) error
+	// Delete removes the identity stored under id.
+	Delete(id IdentityID) error
+	// List returns every IdentityID this store currently has material
+	// for.
+	List() ([]IdentityID, error)
+}
+
+// NewIdentityStore constructs the IdentityStore selected by cfg.
+func NewIdentityStore(cfg IdentityStoreConfig) (IdentityStore, error) {
+	switch cfg.Type {
+	case "", "file":
+		return &fileIdentityStore{dataDir: cfg.DataDir}, nil
+	case "pkcs11":
+		return newPKCS11IdentityStore(cfg)
+	case "awskms", "gcpkms":
+		return newKMSIdentityStore(cfg)
+	default:
+		return nil, trace.BadParameter("unsupported identity storage type %q", cfg.Type)
+	}
+}
+
+// fileIdentityStore is the default IdentityStore: identities are read
+// and written as plain files under DataDir, exactly as ReadLocalIdentity
+// and the ProcessStorage helpers in init.go have always done.
+type fileIdentityStore struct {
+	dataDir string
+}
+
+// Read implements IdentityStore.
+func (f *fileIdentityStore) Read(id IdentityID) (*Identity, error) {
+	return ReadLocalIdentity(f.dataDir, id)
+}
+
+// Write implements IdentityStore.
+func (f *fileIdentityStore) Write(id IdentityID, identity *Identity) error {
+	return WriteLocalIdentity(f.dataDir, *identity, nil)
+}
+
+// Delete implements IdentityStore.
+func (f *fileIdentityStore) Delete(id IdentityID) error {
+	storage, err := NewProcessStorage(context.TODO(), f.dataDir)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	defer storage.Close()
+	if err := storage.DeleteIdentity(IdentityCurrent, id.Roles); err != nil && !trace.IsNotFound(err) {
+		return trace.Wrap(err)
+	}
+	return removeIdentityCompat(f.dataDir, id)
+}
+
+// List implements IdentityStore. It probes only the single-role admin,
+// proxy and node identities: multi-role identities are not listed, and
+// neither is an identity whose key is encrypted at rest, since Read
+// passes no unlock key.
+func (f *fileIdentityStore) List() ([]IdentityID, error) {
+	var ids []IdentityID
+	for _, role := range []teleport.Role{teleport.RoleAdmin, teleport.RoleProxy, teleport.RoleNode} {
+		id := IdentityID{Roles: teleport.Roles{role}}
+		if _, err := f.Read(id); err != nil {
+			if trace.IsNotFound(err) || trace.IsAccessDenied(err) {
+				continue
+			}
+			return nil, trace.Wrap(err)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
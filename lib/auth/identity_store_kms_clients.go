@@ -0,0 +1,111 @@
+/*
+Copyright 2019 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"context"
+
+	kms "cloud.google.com/go/kms/apiv1"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	awskms "github.com/aws/aws-sdk-go/service/kms"
+	"github.com/gravitational/trace"
+	kmspb "google.golang.org/genproto/googleapis/cloud/kms/v1"
+)
+
+// awsKMSEnvelopeCipher implements kmsEnvelopeCipher against AWS KMS's
+// symmetric Encrypt/Decrypt APIs.
+type awsKMSEnvelopeCipher struct {
+	client *awskms.KMS
+}
+
+func newAWSKMSEnvelopeCipher() *awsKMSEnvelopeCipher {
+	sess := session.Must(session.NewSession(&aws.Config{}))
+	return &awsKMSEnvelopeCipher{client: awskms.New(sess)}
+}
+
+// Encrypt implements kmsEnvelopeCipher.
+func (c *awsKMSEnvelopeCipher) Encrypt(keyID string, plaintext []byte) ([]byte, error) {
+	out, err := c.client.Encrypt(&awskms.EncryptInput{
+		KeyId:     aws.String(keyID),
+		Plaintext: plaintext,
+	})
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return out.CiphertextBlob, nil
+}
+
+// Decrypt implements kmsEnvelopeCipher.
+func (c *awsKMSEnvelopeCipher) Decrypt(keyID string, ciphertext []byte) ([]byte, error) {
+	out, err := c.client.Decrypt(&awskms.DecryptInput{
+		KeyId:          aws.String(keyID),
+		CiphertextBlob: ciphertext,
+	})
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return out.Plaintext, nil
+}
+
+// gcpKMSEnvelopeCipher implements kmsEnvelopeCipher against GCP KMS's
+// symmetric Encrypt/Decrypt APIs.
+type gcpKMSEnvelopeCipher struct {
+	client *kms.KeyManagementClient
+}
+
+func newGCPKMSEnvelopeCipher() *gcpKMSEnvelopeCipher {
+	client, err := kms.NewKeyManagementClient(context.Background())
+	if err != nil {
+		// Deferred to first use: constructors used by
+		// NewIdentityStore don't return an error for this helper, but
+		// every call below will fail loudly if the client is nil.
+		log.Errorf("Failed to create GCP KMS client: %v.", err)
+		return &gcpKMSEnvelopeCipher{}
+	}
+	return &gcpKMSEnvelopeCipher{client: client}
+}
+
+// Encrypt implements kmsEnvelopeCipher.
+func (c *gcpKMSEnvelopeCipher) Encrypt(keyName string, plaintext []byte) ([]byte, error) {
+	if c.client == nil {
+		return nil, trace.ConnectionProblem(nil, "GCP KMS client is not initialized")
+	}
+	resp, err := c.client.Encrypt(context.Background(), &kmspb.EncryptRequest{
+		Name:      keyName,
+		Plaintext: plaintext,
+	})
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return resp.Ciphertext, nil
+}
+
+// Decrypt implements kmsEnvelopeCipher.
+func (c *gcpKMSEnvelopeCipher) Decrypt(keyName string, ciphertext []byte) ([]byte, error) {
+	if c.client == nil {
+		return nil, trace.ConnectionProblem(nil, "GCP KMS client is not initialized")
+	}
+	resp, err := c.client.Decrypt(context.Background(), &kmspb.DecryptRequest{
+		Name:       keyName,
+		Ciphertext: ciphertext,
+	})
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return resp.Plaintext, nil
+}
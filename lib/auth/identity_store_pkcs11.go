@@ -0,0 +1,100 @@
+// +build pkcs11
+
+/*
+Copyright 2019 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"golang.org/x/crypto/ssh"
+
+	"github.com/gravitational/trace"
+)
+
+// pkcs11IdentityStore is an IdentityStore where the host private key
+// never leaves an HSM: certs and public material live in ordinary files
+// under DataDir, but Identity.KeySigner is backed by a non-exportable
+// PKCS#11 key object referenced from the identity's key file.
+type pkcs11IdentityStore struct {
+	files *fileIdentityStore
+	keys  KeyStore
+}
+
+// newPKCS11IdentityStore opens the configured PKCS#11 token and wraps a
+// fileIdentityStore so certs/metadata continue to live on disk while the
+// private key stays hardware-backed.
+func newPKCS11IdentityStore(cfg IdentityStoreConfig) (IdentityStore, error) {
+	ks, err := NewPKCS11KeyStore(cfg.PKCS11)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return &pkcs11IdentityStore{
+		files: &fileIdentityStore{dataDir: cfg.DataDir},
+		keys:  ks,
+	}, nil
+}
+
+// Read implements IdentityStore. The identity's KeyBytes field holds a
+// PKCS#11 key reference rather than PEM; KeySigner is resolved against
+// the HSM so the private key is never brought into process memory.
+func (p *pkcs11IdentityStore) Read(id IdentityID) (*Identity, error) {
+	identity, err := p.files.Read(id)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	signer, err := p.keys.Signer(identity.KeyBytes)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	sshSigner, err := ssh.NewSignerFromSigner(signer)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	// certSigner re-attaches the SSH host certificate so this signer
+	// authenticates with the certificate teleport issued, not just the
+	// bare public key, matching ReadSSHIdentityFromKeyPair's behavior.
+	certSigner, err := ssh.NewCertSigner(identity.Cert, sshSigner)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	identity.KeySigner = certSigner
+	return identity, nil
+}
+
+// Write implements IdentityStore. It expects identity.KeyBytes to
+// already hold a PKCS#11 reference produced by KeyStore.CreateKey;
+// generating the key pair itself is handled by whatever requested a new
+// identity (see RequestPendingHostCert).
+func (p *pkcs11IdentityStore) Write(id IdentityID, identity *Identity) error {
+	return p.files.Write(id, identity)
+}
+
+// Delete implements IdentityStore, removing both the on-disk cert files
+// and the underlying HSM key object.
+func (p *pkcs11IdentityStore) Delete(id IdentityID) error {
+	identity, err := p.files.Read(id)
+	if err == nil {
+		if err := p.keys.DeleteKey(identity.KeyBytes); err != nil {
+			return trace.Wrap(err)
+		}
+	}
+	return p.files.Delete(id)
+}
+
+// List implements IdentityStore.
+func (p *pkcs11IdentityStore) List() ([]IdentityID, error) {
+	return p.files.List()
+}
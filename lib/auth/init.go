@@ -133,6 +133,38 @@ type InitConfig struct {
 
 	// KubeconfigPath is an optional path to kubernetes config file
 	KubeconfigPath string
+
+	// UnlockKey, if set, is an administrator-supplied passphrase used to
+	// encrypt CA signing keys at rest with PKCS#8 PBES2 (PBKDF2+AES-256-GCM).
+	// When set, the auth server starts sealed and refuses to sign
+	// certificates until Unlock(key) is called with the matching key.
+	UnlockKey []byte
+
+	// KeyWrapper, when set, overrides the default passphrase-based
+	// KeyWrapper derived from UnlockKey. It is primarily used by tests
+	// that want to exercise the wrap/unwrap path without a real
+	// passphrase.
+	KeyWrapper KeyWrapper
+
+	// KeyStore, when set, causes the SSH signing keys of newly
+	// bootstrapped CAs to be generated inside the configured HSM/KMS
+	// instead of inline. Only the public key and an opaque reference
+	// (e.g. "pkcs11:object=...") are persisted for that key; the TLS CA
+	// key pair is still generated and stored inline. See KeyStore for
+	// which signing paths resolve such references.
+	KeyStore KeyStore
+
+	// SealMode, when set, protects CA signing keys with a master key
+	// split into Shamir shares instead of (or in addition to) a
+	// passphrase. See SealConfig for details.
+	SealMode *SealConfig
+
+	// AdminSocketPath overrides where the auth server's admin RPC
+	// socket (see lib/srv/adminsock) is created. Defaults to
+	// DefaultAdminSocketName under DataDir. Ignored when
+	// SkipPeriodicOperations is set, so tests that don't need it don't
+	// leave a stray socket file behind.
+	AdminSocketPath string
 }
 
 // Init instantiates and configures an instance of AuthServer
@@ -160,6 +192,48 @@ func Init(cfg InitConfig, opts ...AuthServerOption) (*AuthServer, error) {
 	// Set the ciphersuites that this auth server supports.
 	asrv.cipherSuites = cfg.CipherSuites
 
+	// If an unlock key was configured, CA signing keys generated below are
+	// wrapped before they hit the backend. The auth server still comes up
+	// sealed: an explicit Unlock(key) call is required before it will sign
+	// anything, mirroring a Vault-style seal/unseal flow.
+	keyWrapper := cfg.KeyWrapper
+	if keyWrapper == nil && len(cfg.UnlockKey) != 0 {
+		keyWrapper, err = NewPassphraseKeyWrapper(cfg.UnlockKey)
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+	}
+	if keyWrapper != nil {
+		asrv.sealed = true
+	}
+
+	// If Shamir seal mode is configured, CA signing keys generated on
+	// first start are wrapped with a random master key that is
+	// immediately split into shares and discarded from memory. Every
+	// start, including this one, comes up sealed until Unseal is called
+	// with a quorum of shares.
+	if cfg.SealMode != nil {
+		if err := cfg.SealMode.CheckAndSetDefaults(); err != nil {
+			return nil, trace.Wrap(err)
+		}
+		asrv.sealMode = cfg.SealMode
+		asrv.sealed = true
+
+		first, err := isFirstStart(asrv, cfg)
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+		if first {
+			masterKey, shares, err := generateMasterKey(cfg.SealMode)
+			if err != nil {
+				return nil, trace.Wrap(err)
+			}
+			keyWrapper = &masterKeyWrapper{masterKey: masterKey}
+			printSealShares(shares, cfg.SealMode.Threshold)
+			masterKey = nil
+		}
+	}
+
 	// INTERNAL: Authorities (plus Roles) and ReverseTunnels don't follow the
 	// same pattern as the rest of the configuration (they are not configuration
 	// singletons). However, we need to keep them around while Telekube uses them.
@@ -277,7 +351,7 @@ func Init(cfg InitConfig, opts ...AuthServerOption) (*AuthServer, error) {
 		}
 
 		log.Infof("First start: generating user certificate authority.")
-		priv, pub, err := asrv.GenerateKeyPair("")
+		priv, pub, err := generateCASigningKey(asrv, cfg.KeyStore)
 		if err != nil {
 			return nil, trace.Wrap(err)
 		}
@@ -290,6 +364,15 @@ func Init(cfg InitConfig, opts ...AuthServerOption) (*AuthServer, error) {
 			return nil, trace.Wrap(err)
 		}
 
+		signingKeys, err := wrapSigningKeys(keyWrapper, [][]byte{priv})
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+		tlsKeys, err := wrapSigningKeys(keyWrapper, [][]byte{keyPEM})
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+
 		userCA := &services.CertAuthorityV2{
 			Kind:    services.KindCertAuthority,
 			Version: services.V2,
@@ -300,9 +383,9 @@ func Init(cfg InitConfig, opts ...AuthServerOption) (*AuthServer, error) {
 			Spec: services.CertAuthoritySpecV2{
 				ClusterName:  cfg.ClusterName.GetClusterName(),
 				Type:         services.UserCA,
-				SigningKeys:  [][]byte{priv},
+				SigningKeys:  signingKeys,
 				CheckingKeys: [][]byte{pub},
-				TLSKeyPairs:  []services.TLSKeyPair{{Cert: certPEM, Key: keyPEM}},
+				TLSKeyPairs:  []services.TLSKeyPair{{Cert: certPEM, Key: tlsKeys[0]}},
 			},
 		}
 
@@ -318,7 +401,11 @@ func Init(cfg InitConfig, opts ...AuthServerOption) (*AuthServer, error) {
 		if err != nil {
 			return nil, trace.Wrap(err)
 		}
-		userCA.SetTLSKeyPairs([]services.TLSKeyPair{{Cert: certPEM, Key: keyPEM}})
+		tlsKeys, err := wrapSigningKeys(keyWrapper, [][]byte{keyPEM})
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+		userCA.SetTLSKeyPairs([]services.TLSKeyPair{{Cert: certPEM, Key: tlsKeys[0]}})
 		if err := asrv.Trust.UpsertCertAuthority(userCA); err != nil {
 			return nil, trace.Wrap(err)
 		}
@@ -332,7 +419,7 @@ func Init(cfg InitConfig, opts ...AuthServerOption) (*AuthServer, error) {
 		}
 
 		log.Infof("First start: generating host certificate authority.")
-		priv, pub, err := asrv.GenerateKeyPair("")
+		priv, pub, err := generateCASigningKey(asrv, cfg.KeyStore)
 		if err != nil {
 			return nil, trace.Wrap(err)
 		}
@@ -344,6 +431,15 @@ func Init(cfg InitConfig, opts ...AuthServerOption) (*AuthServer, error) {
 		if err != nil {
 			return nil, trace.Wrap(err)
 		}
+		signingKeys, err := wrapSigningKeys(keyWrapper, [][]byte{priv})
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+		tlsKeys, err := wrapSigningKeys(keyWrapper, [][]byte{keyPEM})
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+
 		hostCA = &services.CertAuthorityV2{
 			Kind:    services.KindCertAuthority,
 			Version: services.V2,
@@ -354,9 +450,9 @@ func Init(cfg InitConfig, opts ...AuthServerOption) (*AuthServer, error) {
 			Spec: services.CertAuthoritySpecV2{
 				ClusterName:  cfg.ClusterName.GetClusterName(),
 				Type:         services.HostCA,
-				SigningKeys:  [][]byte{priv},
+				SigningKeys:  signingKeys,
 				CheckingKeys: [][]byte{pub},
-				TLSKeyPairs:  []services.TLSKeyPair{{Cert: certPEM, Key: keyPEM}},
+				TLSKeyPairs:  []services.TLSKeyPair{{Cert: certPEM, Key: tlsKeys[0]}},
 			},
 		}
 		if err := asrv.Trust.UpsertCertAuthority(hostCA); err != nil {
@@ -364,7 +460,17 @@ func Init(cfg InitConfig, opts ...AuthServerOption) (*AuthServer, error) {
 		}
 	} else if len(hostCA.GetTLSKeyPairs()) == 0 {
 		log.Infof("Migrate: generating TLS CA for existing host CA.")
-		privateKey, err := ssh.ParseRawPrivateKey(hostCA.GetSigningKeys()[0])
+		signingKey := hostCA.GetSigningKeys()[0]
+		if keyWrapper != nil {
+			// The signing key may already be wrapped (a cluster that
+			// enabled an unlock key before its first TLS migration) or
+			// still plaintext (one migrating through both changes at
+			// once); only the former needs unwrapping first.
+			if plaintext, err := keyWrapper.Unwrap(signingKey); err == nil {
+				signingKey = plaintext
+			}
+		}
+		privateKey, err := ssh.ParseRawPrivateKey(signingKey)
 		if err != nil {
 			return nil, trace.Wrap(err)
 		}
@@ -379,7 +485,11 @@ func Init(cfg InitConfig, opts ...AuthServerOption) (*AuthServer, error) {
 		if err != nil {
 			return nil, trace.Wrap(err)
 		}
-		hostCA.SetTLSKeyPairs([]services.TLSKeyPair{{Cert: certPEM, Key: keyPEM}})
+		tlsKeys, err := wrapSigningKeys(keyWrapper, [][]byte{keyPEM})
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+		hostCA.SetTLSKeyPairs([]services.TLSKeyPair{{Cert: certPEM, Key: tlsKeys[0]}})
 		if err := asrv.Trust.UpsertCertAuthority(hostCA); err != nil {
 			return nil, trace.Wrap(err)
 		}
@@ -398,9 +508,29 @@ func Init(cfg InitConfig, opts ...AuthServerOption) (*AuthServer, error) {
 		return nil, trace.Wrap(err)
 	}
 
+	// if an unlock key was configured, re-wrap any CA signing keys that
+	// predate it and are still sitting on the backend in plaintext.
+	if keyWrapper != nil {
+		if err := rewrapLegacyCAKeys(asrv, keyWrapper); err != nil {
+			return nil, trace.Wrap(err)
+		}
+	}
+
 	if !cfg.SkipPeriodicOperations {
 		log.Infof("Auth server is running periodic operations.")
 		go asrv.runPeriodicOperations()
+
+		adminSocket, err := asrv.startAdminSocket(&cfg)
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+		asrv.adminSocket = adminSocket
+
+		refreshReconciler, err := asrv.startOIDCRefreshReconciler()
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+		asrv.oidcRefreshReconciler = refreshReconciler
 	} else {
 		log.Infof("Auth server is skipping periodic operations.")
 	}
@@ -439,11 +569,14 @@ func migrateIdentities(dataDir string) error {
 			return trace.Wrap(err)
 		}
 	}
+	if err := fuseCoLocatedIdentities(dataDir, storage); err != nil {
+		return trace.Wrap(err)
+	}
 	return nil
 }
 
 func migrateIdentity(role teleport.Role, dataDir string, storage *ProcessStorage) error {
-	identity, err := readIdentityCompat(dataDir, IdentityID{Role: role})
+	identity, err := readIdentityCompat(dataDir, IdentityID{Roles: teleport.Roles{role}})
 	if err != nil {
 		if !trace.IsNotFound(err) {
 			return trace.Wrap(err)
@@ -454,7 +587,7 @@ func migrateIdentity(role teleport.Role, dataDir string, storage *ProcessStorage
 	if err != nil {
 		return trace.Wrap(err)
 	}
-	err = removeIdentityCompat(dataDir, IdentityID{Role: role})
+	err = removeIdentityCompat(dataDir, IdentityID{Roles: teleport.Roles{role}})
 	if err != nil {
 		if !trace.IsNotFound(err) {
 			return trace.Wrap(err)
@@ -464,6 +597,55 @@ func migrateIdentity(role teleport.Role, dataDir string, storage *ProcessStorage
 	return nil
 }
 
+// fuseCoLocatedIdentities looks for pre-existing single-role identities
+// migrated above that share the same host UUID and key material (i.e.
+// they were issued to the same co-located process running more than one
+// role) and combines them into a single multi-role identity, deleting the
+// now-redundant per-role copies. Identities that don't share key material
+// are left as-is: they belong to genuinely separate processes that happen
+// to run on the same host.
+func fuseCoLocatedIdentities(dataDir string, storage *ProcessStorage) error {
+	var identities []Identity
+	for _, role := range []teleport.Role{teleport.RoleAdmin, teleport.RoleProxy, teleport.RoleNode} {
+		identity, err := storage.ReadIdentity(IdentityCurrent, teleport.Roles{role})
+		if err != nil {
+			if trace.IsNotFound(err) {
+				continue
+			}
+			return trace.Wrap(err)
+		}
+		identities = append(identities, *identity)
+	}
+	if len(identities) < 2 {
+		return nil
+	}
+
+	fused := identities[0]
+	for _, identity := range identities[1:] {
+		if identity.ID.HostUUID != fused.ID.HostUUID || string(identity.KeyBytes) != string(fused.KeyBytes) {
+			return nil
+		}
+		fused.ID.Roles = append(fused.ID.Roles, identity.ID.Roles...)
+	}
+
+	if err := storage.WriteIdentity(IdentityCurrent, fused); err != nil {
+		return trace.Wrap(err)
+	}
+	for _, identity := range identities {
+		if len(identity.ID.Roles) == len(fused.ID.Roles) {
+			continue
+		}
+		if err := storage.DeleteIdentity(IdentityCurrent, identity.ID.Roles); err != nil {
+			if !trace.IsNotFound(err) {
+				return trace.Wrap(err)
+			}
+		}
+	}
+	log.Infof("Migrations: fused co-located identities for host %v into a single %v identity.",
+		fused.ID.HostUUID, fused.ID.Roles)
+	return nil
+}
+
 func migrateUsers(asrv *AuthServer) error {
 	users, err := asrv.GetUsers()
 	if err != nil {
@@ -534,7 +716,7 @@ func GenerateIdentity(a *AuthServer, id IdentityID, additionalPrincipals []strin
 	keys, err := a.GenerateServerKeys(GenerateServerKeysRequest{
 		HostID:               id.HostUUID,
 		NodeName:             id.NodeName,
-		Roles:                teleport.Roles{id.Role},
+		Roles:                id.Roles,
 		AdditionalPrincipals: additionalPrincipals,
 	})
 	if err != nil {
@@ -581,7 +763,7 @@ func (i *Identity) String() string {
 			out = append(out, fmt.Sprintf("trust root(%v:%v)", cert.Subject.CommonName, cert.Subject.SerialNumber))
 		}
 	}
-	return fmt.Sprintf("Identity(%v, %v)", i.ID.Role, strings.Join(out, ","))
+	return fmt.Sprintf("Identity(%v, %v)", i.ID.Roles, strings.Join(out, ","))
 }
 
 // HasTSLConfig returns true if this identity has TLS certificate and private key
@@ -641,9 +823,12 @@ func (i *Identity) TLSConfig(cipherSuites []uint16) (*tls.Config, error) {
 	return tlsConfig, nil
 }
 
-// IdentityID is a combination of role, host UUID, and node name.
+// IdentityID is a combination of roles, host UUID, and node name. A single
+// identity can carry more than one role so a co-located process (e.g. a
+// combined auth+proxy+node binary) can present one certificate that
+// satisfies every role it runs, instead of juggling one identity per role.
 type IdentityID struct {
-	Role     teleport.Role
+	Roles    teleport.Roles
 	HostUUID string
 	NodeName string
 }
@@ -659,12 +844,33 @@ func (id *IdentityID) HostID() (string, error) {
 
 // Equals returns true if two identities are equal
 func (id *IdentityID) Equals(other IdentityID) bool {
-	return id.Role == other.Role && id.HostUUID == other.HostUUID
+	if id.HostUUID != other.HostUUID {
+		return false
+	}
+	if len(id.Roles) != len(other.Roles) {
+		return false
+	}
+	for i := range id.Roles {
+		if id.Roles[i] != other.Roles[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// HasRole returns true if role is one of the roles carried by this identity.
+func (id *IdentityID) HasRole(role teleport.Role) bool {
+	for _, r := range id.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
 }
 
 // String returns debug friendly representation of this identity
 func (id *IdentityID) String() string {
-	return fmt.Sprintf("Identity(hostuuid=%v, role=%v)", id.HostUUID, id.Role)
+	return fmt.Sprintf("Identity(hostuuid=%v, roles=%v)", id.HostUUID, id.Roles)
 }
 
 // ReadIdentityFromKeyPair reads TLS identity from key pair
@@ -713,8 +919,12 @@ func ReadTLSIdentityFromKeyPair(keyBytes, certBytes []byte, caCertsBytes [][]byt
 	if clusterName == "" {
 		return nil, trace.BadParameter("misssing cluster name")
 	}
+	roles := make(teleport.Roles, len(id.Groups))
+	for i, group := range id.Groups {
+		roles[i] = teleport.Role(group)
+	}
 	identity := &Identity{
-		ID:              IdentityID{HostUUID: id.Username, Role: teleport.Role(id.Groups[0])},
+		ID:              IdentityID{HostUUID: id.Username, Roles: roles},
 		ClusterName:     clusterName,
 		KeyBytes:        keyBytes,
 		TLSCertBytes:    certBytes,
@@ -782,19 +992,16 @@ func ReadSSHIdentityFromKeyPair(keyBytes, certBytes []byte) (*Identity, error) {
 	if err != nil {
 		return nil, trace.Wrap(err)
 	}
-	foundRoles := len(roles)
-	if foundRoles != 1 {
-		return nil, trace.Errorf("expected one role per certificate. found %d: '%s'",
-			foundRoles, roles.String())
+	if len(roles) == 0 {
+		return nil, trace.BadParameter("at least one role is required, found none in %v", utils.CertExtensionRole)
 	}
-	role := roles[0]
 	clusterName := cert.Permissions.Extensions[utils.CertExtensionAuthority]
 	if clusterName == "" {
 		return nil, trace.BadParameter("missing cert extension %v", utils.CertExtensionAuthority)
 	}
 
 	return &Identity{
-		ID:          IdentityID{HostUUID: cert.ValidPrincipals[0], Role: role},
+		ID:          IdentityID{HostUUID: cert.ValidPrincipals[0], Roles: roles},
 		ClusterName: clusterName,
 		KeyBytes:    keyBytes,
 		CertBytes:   certBytes,
@@ -806,12 +1013,56 @@ func ReadSSHIdentityFromKeyPair(keyBytes, certBytes []byte) (*Identity, error) {
 // ReadLocalIdentity reads, parses and returns the given pub/pri key + cert from the
 // key storage (dataDir).
 func ReadLocalIdentity(dataDir string, id IdentityID) (*Identity, error) {
+	return ReadLocalIdentityWithUnlockKey(dataDir, id, nil)
+}
+
+// ReadLocalIdentityWithUnlockKey is like ReadLocalIdentity, but transparently
+// decrypts the private key on disk if it was written with WrapIdentityKey.
+// unlockKey may be nil, in which case an on-disk key is expected to be
+// plaintext; passing a non-nil unlockKey against a plaintext key is not
+// an error, it simply has no effect.
+func ReadLocalIdentityWithUnlockKey(dataDir string, id IdentityID, unlockKey []byte) (*Identity, error) {
 	storage, err := NewProcessStorage(context.TODO(), dataDir)
 	if err != nil {
 		return nil, trace.Wrap(err)
 	}
 	defer storage.Close()
-	return storage.ReadIdentity(IdentityCurrent, id.Role)
+
+	identity, err := storage.ReadIdentity(IdentityCurrent, id.Roles)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	if IsWrappedIdentityKey(identity.KeyBytes) {
+		if len(unlockKey) == 0 {
+			return nil, trace.AccessDenied("identity key for %v is encrypted, an unlock key is required", id.Roles)
+		}
+		keyPEM, err := UnwrapIdentityKey(unlockKey, identity.KeyBytes)
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+		identity.KeyBytes = keyPEM
+	}
+	return identity, nil
+}
+
+// WriteLocalIdentity persists identity to dataDir, encrypting its private
+// key with unlockKey first when one is supplied. Passing a nil unlockKey
+// preserves today's plaintext-on-disk behavior.
+func WriteLocalIdentity(dataDir string, identity Identity, unlockKey []byte) error {
+	storage, err := NewProcessStorage(context.TODO(), dataDir)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	defer storage.Close()
+
+	if len(unlockKey) != 0 {
+		wrapped, err := WrapIdentityKey(unlockKey, identity.KeyBytes, identity.ID.String())
+		if err != nil {
+			return trace.Wrap(err)
+		}
+		identity.KeyBytes = wrapped
+	}
+	return storage.WriteIdentity(IdentityCurrent, identity)
 }
 
 // DELETE IN(2.7.0)
@@ -939,12 +1190,15 @@ type paths struct {
 }
 
 // DELETE IN(2.7.0)
-// keysPath returns two full file paths: to the host.key and host.cert
+// keysPath returns the full file paths to the key and certs for id. A
+// multi-role identity still gets a single set of files named after its
+// full role set, rather than one set per embedded role.
 func keysPath(dataDir string, id IdentityID) paths {
+	name := strings.ToLower(id.Roles.String())
 	return paths{
-		key:       filepath.Join(dataDir, fmt.Sprintf("%s.key", strings.ToLower(string(id.Role)))),
-		sshCert:   filepath.Join(dataDir, fmt.Sprintf("%s.cert", strings.ToLower(string(id.Role)))),
-		tlsCert:   filepath.Join(dataDir, fmt.Sprintf("%s.tlscert", strings.ToLower(string(id.Role)))),
-		tlsCACert: filepath.Join(dataDir, fmt.Sprintf("%s.tlscacert", strings.ToLower(string(id.Role)))),
+		key:       filepath.Join(dataDir, fmt.Sprintf("%s.key", name)),
+		sshCert:   filepath.Join(dataDir, fmt.Sprintf("%s.cert", name)),
+		tlsCert:   filepath.Join(dataDir, fmt.Sprintf("%s.tlscert", name)),
+		tlsCACert: filepath.Join(dataDir, fmt.Sprintf("%s.tlscacert", name)),
 	}
 }
@@ -0,0 +1,494 @@
+/*
+Copyright 2019 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/gravitational/teleport"
+	"github.com/gravitational/teleport/lib/backend"
+	"github.com/gravitational/teleport/lib/defaults"
+	"github.com/gravitational/teleport/lib/services"
+	"github.com/gravitational/teleport/lib/tlsca"
+	"github.com/gravitational/teleport/lib/utils"
+
+	"github.com/gravitational/trace"
+	"golang.org/x/crypto/ssh"
+)
+
+// bootstrapTokenVersion is the only join-token format this auth server
+// currently mints. It is embedded in every token so a future format
+// change can be told apart from tokens already handed out.
+const bootstrapTokenVersion = "1"
+
+// defaultBootstrapTokenTTL is used when GenerateBootstrapJoinToken is
+// called with ttl <= 0, matching the `tctl nodes add` default of 30m for
+// its ordinary, non-attested join tokens.
+const defaultBootstrapTokenTTL = 30 * time.Minute
+
+// bootstrapTokenSecretBytes is the amount of random secret material
+// packed into a join token, matching the entropy of the existing
+// static provisioning tokens.
+const bootstrapTokenSecretBytes = 16
+
+// generateSecretHex returns a hex-encoded random secret of n bytes.
+func generateSecretHex(n int) (string, error) {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		return "", trace.Wrap(err)
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// BootstrapJoinToken is the parsed form of a join token minted by
+// GenerateBootstrapJoinToken, laid out as `<version>-<ca-hash>-<secret>`
+// in the spirit of Docker Swarm's SWMTKN-style manager/worker join
+// tokens: the CA hash lets a joining host confirm it is actually talking
+// to the cluster it thinks it is *before* it hands over the secret, so a
+// MITM'd connection is detected rather than silently leaking the secret.
+type BootstrapJoinToken struct {
+	// Version is the token format version, currently always "1".
+	Version string
+	// CAHash is the hex-encoded SHA-256 digest of the cluster's host CA
+	// TLS certificate.
+	CAHash string
+	// Secret is the random, single-use bearer secret a joining host
+	// presents to JoinCluster to prove it holds a valid token.
+	Secret string
+}
+
+// String renders token in its canonical `<version>-<ca-hash>-<secret>`
+// form.
+func (t BootstrapJoinToken) String() string {
+	return strings.Join([]string{t.Version, t.CAHash, t.Secret}, "-")
+}
+
+// ParseBootstrapJoinToken parses a token string produced by
+// GenerateBootstrapJoinToken / BootstrapJoinToken.String.
+func ParseBootstrapJoinToken(token string) (*BootstrapJoinToken, error) {
+	parts := strings.SplitN(token, "-", 3)
+	if len(parts) != 3 {
+		return nil, trace.BadParameter("invalid join token: expected <version>-<ca-hash>-<secret>")
+	}
+	if parts[0] != bootstrapTokenVersion {
+		return nil, trace.BadParameter("unsupported join token version %q", parts[0])
+	}
+	if parts[1] == "" || parts[2] == "" {
+		return nil, trace.BadParameter("invalid join token: missing CA hash or secret")
+	}
+	return &BootstrapJoinToken{Version: parts[0], CAHash: parts[1], Secret: parts[2]}, nil
+}
+
+// hashCACert returns the hex-encoded SHA-256 digest of a PEM-encoded CA
+// certificate, used both to mint a join token's CA hash component and to
+// verify a joining host's presented server certificate against it.
+func hashCACert(certPEM []byte) (string, error) {
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		return "", trace.BadParameter("failed to decode CA certificate PEM")
+	}
+	sum := sha256.Sum256(block.Bytes)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// bootstrapJoinTokenEntry is the in-memory bookkeeping kept for a token
+// minted by GenerateBootstrapJoinToken. Tokens are deliberately not
+// persisted to the backend: they are short-lived (defaultBootstrapTokenTTL
+// unless a ttl is given), and losing an unused one on auth server
+// restart is the safe failure mode.
+type bootstrapJoinTokenEntry struct {
+	roles   teleport.Roles
+	expires time.Time
+}
+
+// GenerateBootstrapJoinToken mints a new join token authorizing a host to
+// claim roles via JoinCluster until ttl elapses. It is the backing
+// implementation of `tctl nodes add --ttl=10m --roles=node`.
+func (a *AuthServer) GenerateBootstrapJoinToken(roles teleport.Roles, ttl time.Duration) (string, error) {
+	if len(roles) == 0 {
+		return "", trace.BadParameter("roles: at least one role is required")
+	}
+	if ttl <= 0 {
+		ttl = defaultBootstrapTokenTTL
+	}
+
+	clusterName, err := a.GetClusterName()
+	if err != nil {
+		return "", trace.Wrap(err)
+	}
+	hostCA, err := a.GetCertAuthority(services.CertAuthID{
+		DomainName: clusterName.GetClusterName(),
+		Type:       services.HostCA,
+	}, false)
+	if err != nil {
+		return "", trace.Wrap(err)
+	}
+	tlsKeyPairs := hostCA.GetTLSKeyPairs()
+	if len(tlsKeyPairs) == 0 {
+		return "", trace.BadParameter("host CA has no TLS key pair yet")
+	}
+	caHash, err := hashCACert(tlsKeyPairs[0].Cert)
+	if err != nil {
+		return "", trace.Wrap(err)
+	}
+
+	secret, err := generateSecretHex(bootstrapTokenSecretBytes)
+	if err != nil {
+		return "", trace.Wrap(err)
+	}
+	token := BootstrapJoinToken{Version: bootstrapTokenVersion, CAHash: caHash, Secret: secret}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.bootstrapTokens == nil {
+		a.bootstrapTokens = make(map[string]bootstrapJoinTokenEntry)
+	}
+	a.bootstrapTokens[secret] = bootstrapJoinTokenEntry{
+		roles:   append(teleport.Roles{}, roles...),
+		expires: time.Now().Add(ttl),
+	}
+	log.Infof("Generated bootstrap join token for roles %v, expiring in %v.", roles, ttl)
+	return token.String(), nil
+}
+
+// consumeBootstrapToken validates secret against the in-memory list of
+// unexpired join tokens and, if it finds a match, removes it (tokens are
+// single-use) and returns the roles it authorizes.
+func (a *AuthServer) consumeBootstrapToken(secret string) (teleport.Roles, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	entry, ok := a.bootstrapTokens[secret]
+	if !ok {
+		return nil, trace.AccessDenied("join token is invalid or has already been used")
+	}
+	delete(a.bootstrapTokens, secret)
+	if time.Now().After(entry.expires) {
+		return nil, trace.AccessDenied("join token has expired")
+	}
+	return entry.roles, nil
+}
+
+// JoinClusterRequest is the payload a host presents to JoinCluster to
+// exchange a bootstrap join token for a signed identity. The host
+// generates its own private key locally and sends only a CSR, so the
+// private key never crosses the wire.
+type JoinClusterRequest struct {
+	// Token is the join token string minted by GenerateBootstrapJoinToken.
+	Token string
+	// CSR is a PEM-encoded PKCS#10 certificate signing request. Its
+	// public key is signed into both the returned SSH host certificate
+	// and TLS certificate.
+	CSR []byte
+	// HostID is the UUID of the joining host.
+	HostID string
+	// NodeName is the DNS name of the joining host.
+	NodeName string
+	// AdditionalPrincipals are extra SSH/DNS principals to embed in the
+	// issued certificates, beyond the host ID and node name.
+	AdditionalPrincipals []string
+}
+
+// JoinClusterResponse is what JoinCluster returns on success: a signed
+// SSH host certificate, a signed TLS certificate, and the CA certificates
+// the joining host should trust.
+type JoinClusterResponse struct {
+	// Cert is the PEM-encoded, CA-signed SSH host certificate.
+	Cert []byte
+	// TLSCert is the PEM-encoded, CA-signed TLS certificate.
+	TLSCert []byte
+	// TLSCACerts are the PEM-encoded host CA certificates the joining
+	// host should trust going forward.
+	TLSCACerts [][]byte
+}
+
+// JoinCluster exchanges a bootstrap join token and CSR for a signed host
+// identity, replacing the old flow of hand-copying a host UUID and static
+// token into a new node's config. The caller is expected to have already
+// verified the auth server's presented TLS certificate against the CA
+// hash embedded in req.Token (VerifyJoinServerCert) before ever sending
+// the secret over the wire; JoinCluster itself re-checks the secret
+// against the in-memory list of unexpired tokens and signs whatever CSR
+// it is handed for the roles the token authorizes.
+func (a *AuthServer) JoinCluster(ctx context.Context, req JoinClusterRequest) (*JoinClusterResponse, error) {
+	if a.IsSealed() {
+		return nil, trace.AccessDenied("auth server is sealed; an administrator must call Unlock before it will sign certificates")
+	}
+
+	token, err := ParseBootstrapJoinToken(req.Token)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	roles, err := a.consumeBootstrapToken(token.Secret)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	csr, err := parseCertificateRequest(req.CSR)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	clusterName, err := a.GetClusterName()
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	hostCA, err := a.GetCertAuthority(services.CertAuthID{
+		DomainName: clusterName.GetClusterName(),
+		Type:       services.HostCA,
+	}, true)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	principals := append([]string{req.HostID, req.NodeName}, req.AdditionalPrincipals...)
+	// Signing here always routes through the inline PEM key path (ks is
+	// nil), same as CA rotation does today; a KeyStore-backed host CA
+	// isn't wired through to the join path yet. keyWrapper unwraps the
+	// signing key when the cluster has an unlock key configured; it is
+	// nil here only if IsSealed above didn't already reject the call.
+	keyWrapper := a.currentKeyWrapper()
+	sshCert, err := signHostSSHCert(hostCA, nil, keyWrapper, csr.PublicKey, req.HostID, roles, principals)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	tlsCert, err := signHostTLSCert(hostCA, nil, keyWrapper, csr.PublicKey, req.HostID, roles, principals)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	var tlsCACerts [][]byte
+	for _, pair := range hostCA.GetTLSKeyPairs() {
+		tlsCACerts = append(tlsCACerts, pair.Cert)
+	}
+
+	log.Infof("Join: host %v joined cluster %v with roles %v via bootstrap token.",
+		req.HostID, clusterName.GetClusterName(), roles)
+	return &JoinClusterResponse{Cert: sshCert, TLSCert: tlsCert, TLSCACerts: tlsCACerts}, nil
+}
+
+// parseCertificateRequest decodes and verifies the self-signature on a
+// PEM-encoded PKCS#10 CSR.
+func parseCertificateRequest(csrPEM []byte) (*x509.CertificateRequest, error) {
+	block, _ := pem.Decode(csrPEM)
+	if block == nil {
+		return nil, trace.BadParameter("failed to decode CSR PEM")
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return nil, trace.BadParameter("failed to parse CSR: %v", err)
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return nil, trace.BadParameter("CSR signature did not verify: %v", err)
+	}
+	return csr, nil
+}
+
+// signHostSSHCert signs pubKey into an SSH host certificate authorizing
+// roles and principals, using the host CA's current signing key.
+func signHostSSHCert(hostCA services.CertAuthority, ks KeyStore, w KeyWrapper, pubKey interface{}, hostID string, roles teleport.Roles, principals []string) ([]byte, error) {
+	signingKeys := hostCA.GetSigningKeys()
+	if len(signingKeys) == 0 {
+		return nil, trace.BadParameter("host CA has no signing key")
+	}
+	caSigner, err := GetSigner(ks, w, signingKeys[0])
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	caSSHSigner, err := ssh.NewSignerFromSigner(caSigner)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	sshPubKey, err := ssh.NewPublicKey(pubKey)
+	if err != nil {
+		return nil, trace.BadParameter("CSR public key is not usable as an SSH key: %v", err)
+	}
+
+	now := time.Now().UTC()
+	cert := &ssh.Certificate{
+		Key:             sshPubKey,
+		CertType:        ssh.HostCert,
+		KeyId:           hostID,
+		ValidPrincipals: principals,
+		ValidAfter:      uint64(now.Add(-1 * time.Minute).Unix()),
+		ValidBefore:     uint64(now.Add(defaults.CATTL).Unix()),
+		Permissions: ssh.Permissions{
+			Extensions: map[string]string{
+				utils.CertExtensionRole:      roles.String(),
+				utils.CertExtensionAuthority: hostCA.GetClusterName(),
+			},
+		},
+	}
+	if err := cert.SignCert(rand.Reader, caSSHSigner); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return ssh.MarshalAuthorizedKey(cert), nil
+}
+
+// signHostTLSCert signs pubKey into a TLS client certificate for hostID,
+// embedding roles as the certificate's subject organization so it reads
+// the same way identities loaded via ReadTLSIdentityFromKeyPair expect.
+// The issuing key is the host CA's TLS key pair, not its SSH signing key:
+// a certificate's signature only verifies against the private key
+// matching the issuer cert's public key (tlsKeyPairs[0].Cert here), and
+// the SSH and TLS CA keys are generated independently.
+func signHostTLSCert(hostCA services.CertAuthority, ks KeyStore, w KeyWrapper, pubKey interface{}, hostID string, roles teleport.Roles, principals []string) ([]byte, error) {
+	tlsKeyPairs := hostCA.GetTLSKeyPairs()
+	if len(tlsKeyPairs) == 0 {
+		return nil, trace.BadParameter("host CA has no TLS key pair")
+	}
+	caSigner, err := GetSigner(ks, w, tlsKeyPairs[0].Key)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	caCert, err := tlsca.ParseCertificatePEM(tlsKeyPairs[0].Cert)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	organization := make([]string, len(roles))
+	for i, role := range roles {
+		organization[i] = string(role)
+	}
+	template := &x509.Certificate{
+		Subject: pkix.Name{
+			CommonName:   hostID,
+			Organization: organization,
+		},
+		DNSNames:     principals,
+		NotBefore:    time.Now().Add(-1 * time.Minute),
+		NotAfter:     time.Now().Add(defaults.CATTL),
+		SerialNumber: newSerialNumber(),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, pubKey, caSigner)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), nil
+}
+
+// newSerialNumber returns a random 128-bit certificate serial number.
+func newSerialNumber() *big.Int {
+	serial := make([]byte, 16)
+	// rand.Read on crypto/rand's global reader never returns a short read
+	// without an error, and an error here would mean the OS entropy
+	// source is broken, which x509.CreateCertificate will fail on anyway.
+	rand.Read(serial)
+	return new(big.Int).SetBytes(serial)
+}
+
+// VerifyJoinServerCert checks that serverCert's SHA-256 digest matches
+// the CA hash embedded in token. A joining host must call this against
+// the certificate presented on its connection to the auth server before
+// sending req.Token's secret to JoinCluster; a mismatch means the
+// connection is not actually terminated by the expected cluster.
+func VerifyJoinServerCert(token *BootstrapJoinToken, serverCert *x509.Certificate) error {
+	sum := sha256.Sum256(serverCert.Raw)
+	if hex.EncodeToString(sum[:]) != token.CAHash {
+		return trace.AccessDenied("server certificate does not match the join token's CA hash")
+	}
+	return nil
+}
+
+// WriteJoinedIdentity builds an Identity out of a JoinCluster response and
+// the private key the host generated locally for its CSR, then persists
+// it via WriteLocalIdentity. Passing unlockKey encrypts the private key at
+// rest exactly as any other host identity written through that path; in
+// all cases the join secret itself is never written to disk; it lives
+// only in memory for the duration of the JoinCluster call.
+func WriteJoinedIdentity(dataDir string, id IdentityID, keyPEM []byte, resp *JoinClusterResponse, unlockKey []byte) (*Identity, error) {
+	identity, err := ReadIdentityFromKeyPair(keyPEM, resp.Cert, resp.TLSCert, resp.TLSCACerts)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	identity.ID = id
+	if err := WriteLocalIdentity(dataDir, *identity, unlockKey); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return identity, nil
+}
+
+// BootstrapConfig is the minimal set of inputs BootstrapCluster needs to
+// bring up a brand-new cluster.
+type BootstrapConfig struct {
+	// Backend is the storage backend for the new cluster's state.
+	Backend backend.Backend
+	// ClusterName is the name of the new cluster.
+	ClusterName services.ClusterName
+	// HostUUID is the UUID of the auth server itself.
+	HostUUID string
+	// NodeName is the DNS name of the auth server itself.
+	NodeName string
+	// DataDir is where the auth server's own identity is written.
+	DataDir string
+	// UnlockKey, if set, encrypts the auth server's own identity key at
+	// rest, the same as InitConfig.UnlockKey does for CA signing keys.
+	UnlockKey []byte
+}
+
+// BootstrapCluster brings up a brand-new cluster in one call: it runs
+// Init() to generate the user and host CAs, then mints and persists an
+// admin identity for the auth server itself, so a freshly provisioned
+// auth server has everything it needs (CAs and its own identity) without
+// a separate manual provisioning step. Equivalent in spirit to Swarm's
+// `docker swarm init`. It is for standing up a new cluster, not for
+// joining an existing one; see JoinCluster for that.
+func BootstrapCluster(cfg BootstrapConfig) (*AuthServer, *Identity, error) {
+	if cfg.DataDir == "" {
+		return nil, nil, trace.BadParameter("DataDir: data dir can not be empty")
+	}
+	if cfg.HostUUID == "" {
+		return nil, nil, trace.BadParameter("HostUUID: host UUID can not be empty")
+	}
+
+	asrv, err := Init(InitConfig{
+		Backend:     cfg.Backend,
+		HostUUID:    cfg.HostUUID,
+		NodeName:    cfg.NodeName,
+		ClusterName: cfg.ClusterName,
+		DataDir:     cfg.DataDir,
+		UnlockKey:   cfg.UnlockKey,
+	})
+	if err != nil {
+		return nil, nil, trace.Wrap(err)
+	}
+
+	id := IdentityID{HostUUID: cfg.HostUUID, NodeName: cfg.NodeName, Roles: teleport.Roles{teleport.RoleAdmin}}
+	identity, err := GenerateIdentity(asrv, id, nil)
+	if err != nil {
+		return nil, nil, trace.Wrap(err)
+	}
+	if err := WriteLocalIdentity(cfg.DataDir, *identity, cfg.UnlockKey); err != nil {
+		return nil, nil, trace.Wrap(err)
+	}
+
+	log.Infof("Bootstrap: cluster %v is ready, auth server identity written to %v.",
+		cfg.ClusterName.GetClusterName(), cfg.DataDir)
+	return asrv, identity, nil
+}
@@ -0,0 +1,281 @@
+/*
+Copyright 2019 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"crypto/x509"
+
+	"github.com/gravitational/teleport"
+
+	"github.com/gravitational/trace"
+)
+
+// ProvisionMethodKind identifies which cloud attestation mechanism a
+// ProvisionMethod verifies.
+type ProvisionMethodKind string
+
+const (
+	// ProvisionMethodToken is the classic shared-secret token join
+	// method: possession of the token string is the only proof of
+	// identity required.
+	ProvisionMethodToken ProvisionMethodKind = "token"
+	// ProvisionMethodEC2 verifies an AWS EC2 instance identity document
+	// and its PKCS7 signature against the AWS regional public keys.
+	ProvisionMethodEC2 ProvisionMethodKind = "ec2_iid"
+	// ProvisionMethodGCP verifies a GCP instance identity JWT against
+	// Google's public JWKS endpoint.
+	ProvisionMethodGCP ProvisionMethodKind = "gcp_iid"
+	// ProvisionMethodAzure verifies Azure IMDS attested data signed by
+	// the regional Azure key.
+	ProvisionMethodAzure ProvisionMethodKind = "azure_iid"
+)
+
+// CloudAttestation is the parsed, verified result of a cloud instance
+// identity attestation, as returned by RegisterUsingCloudAttestation.
+type CloudAttestation struct {
+	// AccountID is the AWS account ID, GCP project ID, or Azure
+	// subscription ID the instance belongs to.
+	AccountID string
+	// Region is the cloud region the instance is running in.
+	Region string
+	// InstanceID uniquely identifies the instance within AccountID.
+	InstanceID string
+}
+
+// ProvisionMethod verifies a join request's cloud-provided attestation
+// document and returns the identity it proves, or an error if the
+// attestation doesn't verify or doesn't match the token's constraints.
+type ProvisionMethod interface {
+	// Kind identifies this ProvisionMethod.
+	Kind() ProvisionMethodKind
+	// Verify checks the attestation document/signature pair supplied by
+	// the joining host and returns the cloud identity it proves.
+	Verify(attestationDocument, signature []byte) (*CloudAttestation, error)
+}
+
+// CloudJoinConstraints restricts which cloud identities a provisioning
+// token backed by a ProvisionMethod will accept, in addition to the
+// token's usual Roles.
+type CloudJoinConstraints struct {
+	// AllowedAccountIDs restricts joins to these AWS account / GCP
+	// project / Azure subscription IDs. Empty means allow any.
+	AllowedAccountIDs []string
+	// AllowedRegions restricts joins to these cloud regions. Empty means
+	// allow any.
+	AllowedRegions []string
+}
+
+// matches returns nil if attestation satisfies c, or an access denied
+// error describing which constraint failed.
+func (c CloudJoinConstraints) matches(attestation *CloudAttestation) error {
+	if len(c.AllowedAccountIDs) != 0 && !utilsSliceContainsStr(c.AllowedAccountIDs, attestation.AccountID) {
+		return trace.AccessDenied("account %q is not allowed to use this token", attestation.AccountID)
+	}
+	if len(c.AllowedRegions) != 0 && !utilsSliceContainsStr(c.AllowedRegions, attestation.Region) {
+		return trace.AccessDenied("region %q is not allowed to use this token", attestation.Region)
+	}
+	return nil
+}
+
+// utilsSliceContainsStr is a tiny local helper mirroring
+// utils.SliceContainsStr, kept unexported here to avoid a hard dependency
+// on the exact signature of that helper across versions.
+func utilsSliceContainsStr(slice []string, val string) bool {
+	for _, s := range slice {
+		if s == val {
+			return true
+		}
+	}
+	return false
+}
+
+// RegisterUsingCloudAttestation verifies a join request's attestation
+// document with method and checks the result against constraints,
+// returning the verified CloudAttestation. It does not issue
+// certificates or register the host itself; req is used only for
+// logging.
+func (a *AuthServer) RegisterUsingCloudAttestation(
+	method ProvisionMethod,
+	constraints CloudJoinConstraints,
+	attestationDocument, signature []byte,
+	req GenerateServerKeysRequest,
+) (*CloudAttestation, error) {
+
+	attestation, err := method.Verify(attestationDocument, signature)
+	if err != nil {
+		return nil, trace.Wrap(err, "cloud attestation did not verify")
+	}
+	if err := constraints.matches(attestation); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	log.Infof("Cloud join: verified %v instance %v in account %v (%v) for host %v.",
+		method.Kind(), attestation.InstanceID, attestation.AccountID, attestation.Region, req.HostID)
+	return attestation, nil
+}
+
+// parseTrustedRegionalCerts parses a region->PEM map of trust anchors
+// into region->*x509.Certificate, failing closed on any entry that
+// doesn't parse.
+func parseTrustedRegionalCerts(certsPEM map[string][]byte) (map[string]*x509.Certificate, error) {
+	certs := make(map[string]*x509.Certificate, len(certsPEM))
+	for region, certPEM := range certsPEM {
+		cert, err := parsePEMCertificate(certPEM)
+		if err != nil {
+			return nil, trace.Wrap(err, "parsing pinned certificate for region %q", region)
+		}
+		certs[region] = cert
+	}
+	return certs, nil
+}
+
+// awsEC2ProvisionMethod verifies AWS EC2 instance identity documents.
+// The document is a JSON blob describing the instance; signature is its
+// detached PKCS7/RSA-SHA256 signature, verified against the pinned
+// per-region AWS public certificate it was constructed with.
+type awsEC2ProvisionMethod struct {
+	trustedCerts map[string]*x509.Certificate
+}
+
+// NewAWSEC2ProvisionMethod returns a ProvisionMethod that verifies AWS
+// EC2 instance identity documents against the given region->PEM map of
+// pinned AWS public certificates. Certificates are not fetched over the
+// network at verify time: trustedRegionalCerts must already contain an
+// entry for every region instances are expected to join from.
+func NewAWSEC2ProvisionMethod(trustedRegionalCerts map[string][]byte) (ProvisionMethod, error) {
+	certs, err := parseTrustedRegionalCerts(trustedRegionalCerts)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return &awsEC2ProvisionMethod{trustedCerts: certs}, nil
+}
+
+// Kind implements ProvisionMethod.
+func (m *awsEC2ProvisionMethod) Kind() ProvisionMethodKind { return ProvisionMethodEC2 }
+
+// Verify implements ProvisionMethod.
+func (m *awsEC2ProvisionMethod) Verify(doc, signature []byte) (*CloudAttestation, error) {
+	iid, err := parseEC2InstanceIdentityDocument(doc)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	cert, ok := m.trustedCerts[iid.Region]
+	if !ok {
+		return nil, trace.AccessDenied("no pinned AWS certificate configured for region %q", iid.Region)
+	}
+	if err := verifyEC2PKCS7Signature(doc, signature, cert); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return &CloudAttestation{
+		AccountID:  iid.AccountID,
+		Region:     iid.Region,
+		InstanceID: iid.InstanceID,
+	}, nil
+}
+
+// gcpProvisionMethod verifies GCP instance identity JWTs.
+type gcpProvisionMethod struct {
+	expectedAudience string
+}
+
+// NewGCPProvisionMethod returns a ProvisionMethod that verifies GCP
+// instance identity JWTs against Google's public JWKS. expectedAudience
+// must match the "aud" claim GCP was asked to stamp into the JWT
+// (typically the cluster's public address) — without it, a JWT minted
+// for an entirely different service would verify just as well.
+func NewGCPProvisionMethod(expectedAudience string) ProvisionMethod {
+	return &gcpProvisionMethod{expectedAudience: expectedAudience}
+}
+
+// Kind implements ProvisionMethod.
+func (m *gcpProvisionMethod) Kind() ProvisionMethodKind { return ProvisionMethodGCP }
+
+// Verify implements ProvisionMethod.
+func (m *gcpProvisionMethod) Verify(jwt, _ []byte) (*CloudAttestation, error) {
+	claims, err := verifyGCPIdentityJWT(jwt, m.expectedAudience)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return &CloudAttestation{
+		AccountID:  claims.ProjectID,
+		Region:     claims.Zone,
+		InstanceID: claims.InstanceID,
+	}, nil
+}
+
+// azureProvisionMethod verifies Azure IMDS attested data.
+type azureProvisionMethod struct {
+	trustedCerts map[string]*x509.Certificate
+}
+
+// NewAzureProvisionMethod returns a ProvisionMethod that verifies Azure
+// IMDS attested data signed by the pinned regional Azure key. As with
+// NewAWSEC2ProvisionMethod, certificates are not fetched over the
+// network at verify time.
+func NewAzureProvisionMethod(trustedRegionalCerts map[string][]byte) (ProvisionMethod, error) {
+	certs, err := parseTrustedRegionalCerts(trustedRegionalCerts)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return &azureProvisionMethod{trustedCerts: certs}, nil
+}
+
+// Kind implements ProvisionMethod.
+func (m *azureProvisionMethod) Kind() ProvisionMethodKind { return ProvisionMethodAzure }
+
+// Verify implements ProvisionMethod.
+func (m *azureProvisionMethod) Verify(doc, signature []byte) (*CloudAttestation, error) {
+	attested, err := verifyAzureAttestedData(doc, signature, m.trustedCerts)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return &CloudAttestation{
+		AccountID:  attested.SubscriptionID,
+		Region:     attested.Region,
+		InstanceID: attested.VMID,
+	}, nil
+}
+
+// ProvisionMethodConfig supplies the trust material each cloud
+// ProvisionMethod needs to verify attestations without reaching out to
+// the network at verify time.
+type ProvisionMethodConfig struct {
+	// AWSRegionalCerts pins the AWS public certificate used to verify EC2
+	// instance identity document signatures, keyed by region.
+	AWSRegionalCerts map[string][]byte
+	// AzureRegionalCerts pins the Azure public certificate used to verify
+	// IMDS attested data signatures, keyed by region.
+	AzureRegionalCerts map[string][]byte
+	// GCPExpectedAudience is the value GCP instance identity JWTs must
+	// present in their "aud" claim.
+	GCPExpectedAudience string
+}
+
+// ProvisionMethodForRole returns the cloud-join ProvisionMethod for kind,
+// built from the trust material in cfg. The choice depends on kind alone;
+// role only appears in the error returned for an unsupported kind.
+func ProvisionMethodForRole(kind ProvisionMethodKind, role teleport.Role, cfg ProvisionMethodConfig) (ProvisionMethod, error) {
+	switch kind {
+	case ProvisionMethodEC2:
+		return NewAWSEC2ProvisionMethod(cfg.AWSRegionalCerts)
+	case ProvisionMethodGCP:
+		return NewGCPProvisionMethod(cfg.GCPExpectedAudience), nil
+	case ProvisionMethodAzure:
+		return NewAzureProvisionMethod(cfg.AzureRegionalCerts)
+	default:
+		return nil, trace.BadParameter("unsupported cloud provision method %q for role %v", kind, role)
+	}
+}
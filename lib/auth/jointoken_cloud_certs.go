@@ -0,0 +1,117 @@
+/*
+Copyright 2019 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+
+	"github.com/fullsailor/pkcs7"
+	"github.com/gravitational/trace"
+)
+
+// googleJWKSURL is Google's published JWKS endpoint for verifying
+// instance identity JWTs. Unlike the AWS/Azure regional certificates
+// below, Google rotates these keys routinely and expects callers to
+// fetch them live, so this one is not pinned.
+const googleJWKSURL = "https://www.googleapis.com/oauth2/v3/certs"
+
+// parsePEMCertificate parses a single PEM-encoded certificate. It is
+// used to load the pinned AWS/Azure trust anchors a ProvisionMethod is
+// constructed with, rather than fetching them over HTTP at verify time:
+// an attacker on path for that fetch (or a compromised/typo'd endpoint)
+// could hand back a certificate of their own choosing and sign
+// attestations Teleport would then trust.
+func parsePEMCertificate(certPEM []byte) (*x509.Certificate, error) {
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		return nil, trace.BadParameter("no PEM certificate found")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return cert, nil
+}
+
+// verifyJWTAgainstGoogleJWKS verifies a GCP instance identity JWT's
+// signature against Google's published JWKS and returns the instance
+// claims it contains. expectedAudience is checked against the JWT's
+// "aud" claim; without it, any JWT Google issued for any project or
+// audience would verify just as well as one minted for this cluster.
+func verifyJWTAgainstGoogleJWKS(jwt []byte, expectedAudience string) (*gcpIdentityClaims, error) {
+	claims, err := parseAndVerifyJWT(jwt, googleJWKSURL, googleIdentityIssuer, expectedAudience)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	google, ok := claims["google"].(map[string]interface{})
+	if !ok {
+		return nil, trace.BadParameter("GCP identity JWT missing google claim")
+	}
+	computeEngine, ok := google["compute_engine"].(map[string]interface{})
+	if !ok {
+		return nil, trace.BadParameter("GCP identity JWT missing compute_engine claim")
+	}
+	return &gcpIdentityClaims{
+		ProjectID:  fmt.Sprintf("%v", computeEngine["project_id"]),
+		Zone:       fmt.Sprintf("%v", computeEngine["zone"]),
+		InstanceID: fmt.Sprintf("%v", computeEngine["instance_id"]),
+	}, nil
+}
+
+// verifyAzurePKCS7Signature verifies Azure IMDS attested data's detached
+// PKCS7 signature against the pinned certificate for the data's region
+// and extracts the subscription/region/VM ID it attests to.
+// trustedCerts must be pre-populated (see NewAzureProvisionMethod); there
+// is no regional certificate here for Teleport to fetch on demand.
+func verifyAzurePKCS7Signature(doc, signature []byte, trustedCerts map[string]*x509.Certificate) (*azureAttestedData, error) {
+	var parsed struct {
+		SubscriptionID string `json:"subscriptionId"`
+		VMID           string `json:"vmId"`
+		SKU            string `json:"sku"`
+		Region         string `json:"region"`
+	}
+	if err := json.Unmarshal(doc, &parsed); err != nil {
+		return nil, trace.BadParameter("invalid Azure attested data: %v", err)
+	}
+	if parsed.SubscriptionID == "" || parsed.VMID == "" {
+		return nil, trace.BadParameter("Azure attested data missing required fields")
+	}
+
+	cert, ok := trustedCerts[parsed.Region]
+	if !ok {
+		return nil, trace.AccessDenied("no pinned Azure certificate configured for region %q", parsed.Region)
+	}
+	p7, err := pkcs7.Parse(signature)
+	if err != nil {
+		return nil, trace.BadParameter("failed to parse Azure attested data signature: %v", err)
+	}
+	p7.Content = doc
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	if err := p7.VerifyWithChain(pool); err != nil {
+		return nil, trace.AccessDenied("Azure attested data signature did not verify: %v", err)
+	}
+
+	return &azureAttestedData{
+		SubscriptionID: parsed.SubscriptionID,
+		Region:         parsed.Region,
+		VMID:           parsed.VMID,
+	}, nil
+}
@@ -0,0 +1,104 @@
+/*
+Copyright 2019 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"crypto/x509"
+	"encoding/json"
+
+	"github.com/fullsailor/pkcs7"
+	"github.com/gravitational/trace"
+)
+
+// ec2InstanceIdentityDocument is the subset of fields Teleport cares
+// about from AWS's instance identity document.
+// See: https://docs.aws.amazon.com/AWSEC2/latest/UserGuide/instance-identity-documents.html
+type ec2InstanceIdentityDocument struct {
+	AccountID  string `json:"accountId"`
+	Region     string `json:"region"`
+	InstanceID string `json:"instanceId"`
+}
+
+// parseEC2InstanceIdentityDocument unmarshals a raw AWS instance identity
+// document.
+func parseEC2InstanceIdentityDocument(doc []byte) (*ec2InstanceIdentityDocument, error) {
+	var iid ec2InstanceIdentityDocument
+	if err := json.Unmarshal(doc, &iid); err != nil {
+		return nil, trace.BadParameter("invalid EC2 instance identity document: %v", err)
+	}
+	if iid.AccountID == "" || iid.Region == "" || iid.InstanceID == "" {
+		return nil, trace.BadParameter("EC2 instance identity document missing required fields")
+	}
+	return &iid, nil
+}
+
+// verifyEC2PKCS7Signature verifies the detached PKCS7 signature AWS
+// attaches to an instance identity document against cert, the pinned
+// public certificate for the document's region.
+func verifyEC2PKCS7Signature(doc, signature []byte, cert *x509.Certificate) error {
+	p7, err := pkcs7.Parse(signature)
+	if err != nil {
+		return trace.BadParameter("failed to parse EC2 identity document signature: %v", err)
+	}
+	p7.Content = doc
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	if err := p7.VerifyWithChain(pool); err != nil {
+		return trace.AccessDenied("EC2 instance identity document signature did not verify: %v", err)
+	}
+	return nil
+}
+
+// googleIdentityIssuer is the only "iss" value Google ever puts in an
+// instance identity JWT. Pinning it means a validly-signed JWT Google
+// issued for some unrelated purpose can't be replayed here.
+const googleIdentityIssuer = "https://accounts.google.com"
+
+// gcpIdentityClaims are the claims Teleport reads out of a verified GCP
+// instance identity JWT.
+type gcpIdentityClaims struct {
+	ProjectID  string
+	Zone       string
+	InstanceID string
+}
+
+// verifyGCPIdentityJWT verifies a GCP instance identity JWT against
+// Google's public JWKS (https://www.googleapis.com/oauth2/v3/certs),
+// checks its issuer and audience, and extracts the instance's project,
+// zone, and ID from its "google" claim. expectedAudience must match the
+// token's "aud" claim exactly; see NewGCPProvisionMethod.
+func verifyGCPIdentityJWT(jwt []byte, expectedAudience string) (*gcpIdentityClaims, error) {
+	claims, err := verifyJWTAgainstGoogleJWKS(jwt, expectedAudience)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return claims, nil
+}
+
+// azureAttestedData is the subset of Azure IMDS attested data Teleport
+// cares about.
+type azureAttestedData struct {
+	SubscriptionID string
+	Region         string
+	VMID           string
+}
+
+// verifyAzureAttestedData verifies IMDS attested data signed by the
+// pinned regional Azure key.
+func verifyAzureAttestedData(doc, signature []byte, trustedCerts map[string]*x509.Certificate) (*azureAttestedData, error) {
+	return verifyAzurePKCS7Signature(doc, signature, trustedCerts)
+}
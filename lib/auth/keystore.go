@@ -0,0 +1,208 @@
+/*
+Copyright 2019 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"strings"
+
+	"github.com/gravitational/teleport/lib/services"
+
+	"github.com/gravitational/trace"
+)
+
+// KeyStoreURIScheme identifies which backend a key reference belongs to,
+// e.g. "pkcs11", "awskms" or "gcpkms".
+type KeyStoreURIScheme string
+
+const (
+	// KeyStorePKCS11 is the scheme used for keys held in an HSM reachable
+	// over PKCS#11, e.g. "pkcs11:object=teleport-host-ca;token=prod".
+	KeyStorePKCS11 KeyStoreURIScheme = "pkcs11"
+	// KeyStoreAWSKMS is the scheme used for keys held in AWS KMS, e.g.
+	// "awskms:arn:aws:kms:us-east-1:1234567890:key/abcd-efgh".
+	KeyStoreAWSKMS KeyStoreURIScheme = "awskms"
+	// KeyStoreGCPKMS is the scheme used for keys held in GCP KMS, e.g.
+	// "gcpkms:projects/p/locations/l/keyRings/r/cryptoKeys/k".
+	KeyStoreGCPKMS KeyStoreURIScheme = "gcpkms"
+)
+
+// KeyStore is an abstraction over where CA private key material actually
+// lives. The default behavior (no KeyStore configured) keeps generating
+// and storing raw PEM-encoded keys inline in CertAuthoritySpecV2, exactly
+// as Init() has always done. When a KeyStore is configured, Init()
+// generates the CA's SSH signing key inside the backing HSM/KMS and
+// persists only the returned reference plus the public key; the TLS CA
+// key pair is still generated and stored inline. GetSigner resolves such
+// a reference through Signer(ref); its callers in this package pass a
+// nil KeyStore, so they reject a reference-backed signing key.
+type KeyStore interface {
+	// Name identifies this KeyStore implementation, e.g. "pkcs11".
+	Name() KeyStoreURIScheme
+
+	// CreateKey generates a new RSA key pair inside the backing store
+	// and returns an opaque reference to it along with the PEM-encoded
+	// public key.
+	CreateKey() (ref []byte, pub []byte, err error)
+
+	// Signer returns a crypto.Signer backed by the key identified by
+	// ref. The private key never leaves the KeyStore implementation.
+	Signer(ref []byte) (crypto.Signer, error)
+
+	// DeleteKey removes the key identified by ref from the backing
+	// store. It is used by the PKCS#11 identity store when an identity is
+	// deleted.
+	DeleteKey(ref []byte) error
+}
+
+// ParseKeyStoreURI splits a key reference such as "pkcs11:object=host-ca"
+// into its scheme and the backend-specific remainder.
+func ParseKeyStoreURI(uri string) (KeyStoreURIScheme, string, error) {
+	parts := strings.SplitN(uri, ":", 2)
+	if len(parts) != 2 {
+		return "", "", trace.BadParameter("invalid key reference %q, expected scheme:rest", uri)
+	}
+	return KeyStoreURIScheme(parts[0]), parts[1], nil
+}
+
+// IsKeyReference returns true if key looks like an opaque KeyStore
+// reference (e.g. "pkcs11:...") rather than inline PEM-encoded key
+// material.
+func IsKeyReference(key []byte) bool {
+	for _, scheme := range []KeyStoreURIScheme{KeyStorePKCS11, KeyStoreAWSKMS, KeyStoreGCPKMS} {
+		if strings.HasPrefix(string(key), string(scheme)+":") {
+			return true
+		}
+	}
+	return false
+}
+
+// GetSigner returns a crypto.Signer for signingKey, transparently
+// dispatching to ks when signingKey is an opaque KeyStore reference, or
+// unwrapping (if w is non-nil) and parsing it as an inline PEM RSA
+// private key otherwise. ks and w may both be nil: ks if no KeyStore is
+// configured, in which case signingKey must be inline PEM; w if no
+// cluster unlock key is configured, in which case inline PEM keys are
+// stored and read back in plaintext.
+func GetSigner(ks KeyStore, w KeyWrapper, signingKey []byte) (crypto.Signer, error) {
+	if !IsKeyReference(signingKey) {
+		if w != nil {
+			plaintext, err := w.Unwrap(signingKey)
+			if err != nil {
+				return nil, trace.Wrap(err)
+			}
+			signingKey = plaintext
+		}
+		return parsePEMSigner(signingKey)
+	}
+	if ks == nil {
+		return nil, trace.BadParameter("signing key is a KeyStore reference but no KeyStore is configured")
+	}
+	return ks.Signer(signingKey)
+}
+
+// parsePEMSigner parses an inline PEM-encoded RSA private key into a
+// crypto.Signer, used for the default (non-KeyStore) signing path.
+func parsePEMSigner(keyPEM []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, trace.BadParameter("failed to decode PEM signing key")
+	}
+	key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return key, nil
+}
+
+// pemEncodePublicKey PEM-encodes a DER-encoded SubjectPublicKeyInfo,
+// used by the KMS-backed KeyStores when returning newly generated public
+// keys.
+func pemEncodePublicKey(der []byte) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+}
+
+// generateCASigningKey generates a new CA signing key pair, either
+// inline via the auth server's usual key generator or, when ks is
+// configured, inside the backing HSM/KMS. In the latter case priv is an
+// opaque KeyStore reference rather than PEM-encoded key material.
+func generateCASigningKey(asrv *AuthServer, ks KeyStore) (priv, pub []byte, err error) {
+	if ks == nil {
+		priv, pub, err = asrv.GenerateKeyPair("")
+		return priv, pub, trace.Wrap(err)
+	}
+	priv, pub, err = ks.CreateKey()
+	return priv, pub, trace.Wrap(err)
+}
+
+// MigrateCAKeysToKeyStore rewrites the user and host CA resources so that
+// their signing keys are held as KeyStore references. Importing an inline
+// PEM key into ks is not supported (see importPEMKeyIntoKeyStore): a CA
+// that still holds one makes this function return a NotImplemented error
+// without rewriting that CA. Signing keys that are already references are
+// kept as they are.
+func MigrateCAKeysToKeyStore(asrv *AuthServer, ks KeyStore) error {
+	clusterName, err := asrv.GetClusterName()
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	for _, caType := range []services.CertAuthType{services.UserCA, services.HostCA} {
+		ca, err := asrv.GetCertAuthority(services.CertAuthID{
+			DomainName: clusterName.GetClusterName(),
+			Type:       caType,
+		}, true)
+		if err != nil {
+			if trace.IsNotFound(err) {
+				continue
+			}
+			return trace.Wrap(err)
+		}
+		signingKeys := ca.GetSigningKeys()
+		migrated := make([][]byte, len(signingKeys))
+		for i, key := range signingKeys {
+			if IsKeyReference(key) {
+				migrated[i] = key
+				continue
+			}
+			ref, err := importPEMKeyIntoKeyStore(ks, key)
+			if err != nil {
+				return trace.Wrap(err)
+			}
+			migrated[i] = ref
+		}
+		ca.SetSigningKeys(migrated)
+		if err := asrv.Trust.UpsertCertAuthority(ca); err != nil {
+			return trace.Wrap(err)
+		}
+		log.Infof("Migrated %v signing keys into %v KeyStore.", caType, ks.Name())
+	}
+	return nil
+}
+
+// importPEMKeyIntoKeyStore is a placeholder import path: most HSMs/KMS
+// providers require out-of-band import tooling (pkcs11-tool, kms
+// import-key-material, ...) rather than accepting raw key bytes over the
+// same API used for generation. Callers that can't import in-place
+// should instead rotate to a KeyStore-generated key via
+// AuthServer.RotateCertAuthority.
+func importPEMKeyIntoKeyStore(ks KeyStore, pemKey []byte) ([]byte, error) {
+	return nil, trace.NotImplemented(
+		"importing existing PEM keys into a %v KeyStore is not supported; "+
+			"rotate the CA instead so a new key is generated inside the KeyStore", ks.Name())
+}
@@ -0,0 +1,161 @@
+/*
+Copyright 2019 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"crypto"
+	"crypto/x509"
+	"io"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/gravitational/trace"
+)
+
+// awsKMSKeyStore is a KeyStore backed by AWS KMS asymmetric CMKs. CA
+// private key material never leaves KMS; signing is performed with the
+// kms:Sign API and the reference persisted is the key's ARN.
+type awsKMSKeyStore struct {
+	client *kms.KMS
+}
+
+// NewAWSKMSKeyStore returns a KeyStore that generates and signs with RSA
+// CMKs in the given AWS region.
+func NewAWSKMSKeyStore(region string) (KeyStore, error) {
+	sess, err := session.NewSession(&aws.Config{Region: aws.String(region)})
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return &awsKMSKeyStore{client: kms.New(sess)}, nil
+}
+
+// Name implements KeyStore.
+func (a *awsKMSKeyStore) Name() KeyStoreURIScheme { return KeyStoreAWSKMS }
+
+// CreateKey implements KeyStore, creating an RSA_4096 SIGN_VERIFY CMK and
+// returning a reference of the form "awskms:<key-arn>".
+func (a *awsKMSKeyStore) CreateKey() ([]byte, []byte, error) {
+	out, err := a.client.CreateKey(&kms.CreateKeyInput{
+		KeyUsage: aws.String(kms.KeyUsageTypeSignVerify),
+		KeySpec:  aws.String(kms.KeySpecRsa4096),
+	})
+	if err != nil {
+		return nil, nil, trace.Wrap(err)
+	}
+	keyID := aws.StringValue(out.KeyMetadata.Arn)
+	pub, err := a.publicKeyPEM(keyID)
+	if err != nil {
+		return nil, nil, trace.Wrap(err)
+	}
+	ref := []byte(string(KeyStoreAWSKMS) + ":" + keyID)
+	return ref, pub, nil
+}
+
+// Signer implements KeyStore.
+func (a *awsKMSKeyStore) Signer(ref []byte) (crypto.Signer, error) {
+	_, keyID, err := ParseKeyStoreURI(string(ref))
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	pub, err := a.publicKey(keyID)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return &awsKMSSigner{client: a.client, keyID: keyID, public: pub}, nil
+}
+
+// DeleteKey implements KeyStore by scheduling the CMK for deletion, the
+// minimum retention window KMS allows.
+func (a *awsKMSKeyStore) DeleteKey(ref []byte) error {
+	_, keyID, err := ParseKeyStoreURI(string(ref))
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	_, err = a.client.ScheduleKeyDeletion(&kms.ScheduleKeyDeletionInput{
+		KeyId:               aws.String(keyID),
+		PendingWindowInDays: aws.Int64(7),
+	})
+	return trace.Wrap(err)
+}
+
+func (a *awsKMSKeyStore) publicKey(keyID string) (crypto.PublicKey, error) {
+	out, err := a.client.GetPublicKey(&kms.GetPublicKeyInput{KeyId: aws.String(keyID)})
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	pub, err := x509.ParsePKIXPublicKey(out.PublicKey)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return pub, nil
+}
+
+func (a *awsKMSKeyStore) publicKeyPEM(keyID string) ([]byte, error) {
+	pub, err := a.publicKey(keyID)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return pemEncodePublicKey(der), nil
+}
+
+// awsKMSSigner implements crypto.Signer via the KMS Sign API.
+type awsKMSSigner struct {
+	client *kms.KMS
+	keyID  string
+	public crypto.PublicKey
+}
+
+// Public implements crypto.Signer.
+func (s *awsKMSSigner) Public() crypto.PublicKey {
+	return s.public
+}
+
+// Sign implements crypto.Signer.
+func (s *awsKMSSigner) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	alg, err := kmsSigningAlgorithmFor(opts)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	out, err := s.client.Sign(&kms.SignInput{
+		KeyId:            aws.String(s.keyID),
+		Message:          digest,
+		MessageType:      aws.String(kms.MessageTypeDigest),
+		SigningAlgorithm: aws.String(alg),
+	})
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return out.Signature, nil
+}
+
+// kmsSigningAlgorithmFor maps a crypto.SignerOpts hash to the matching
+// KMS RSASSA_PKCS1_V1_5 signing algorithm.
+func kmsSigningAlgorithmFor(opts crypto.SignerOpts) (string, error) {
+	switch opts.HashFunc() {
+	case crypto.SHA256:
+		return kms.SigningAlgorithmSpecRsassaPkcs1V15Sha256, nil
+	case crypto.SHA512:
+		return kms.SigningAlgorithmSpecRsassaPkcs1V15Sha512, nil
+	default:
+		return "", trace.BadParameter("unsupported hash function %v for KMS signing", opts.HashFunc())
+	}
+}
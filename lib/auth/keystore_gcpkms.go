@@ -0,0 +1,171 @@
+/*
+Copyright 2019 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+
+	kms "cloud.google.com/go/kms/apiv1"
+	"github.com/gravitational/trace"
+	kmspb "google.golang.org/genproto/googleapis/cloud/kms/v1"
+)
+
+// gcpKMSKeyStore is a KeyStore backed by a GCP KMS key ring. CA private
+// key material never leaves KMS; the reference persisted is the crypto
+// key version's resource name.
+type gcpKMSKeyStore struct {
+	client  *kms.KeyManagementClient
+	keyRing string
+	purpose kmspb.CryptoKey_CryptoKeyPurpose
+	algo    kmspb.CryptoKeyVersion_CryptoKeyVersionAlgorithm
+}
+
+// NewGCPKMSKeyStore returns a KeyStore that generates and signs with RSA
+// keys under the given GCP KMS key ring, e.g.
+// "projects/p/locations/l/keyRings/r".
+func NewGCPKMSKeyStore(keyRing string) (KeyStore, error) {
+	client, err := kms.NewKeyManagementClient(context.Background())
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return &gcpKMSKeyStore{
+		client:  client,
+		keyRing: keyRing,
+		purpose: kmspb.CryptoKey_ASYMMETRIC_SIGN,
+		algo:    kmspb.CryptoKeyVersion_RSA_SIGN_PKCS1_2048_SHA256,
+	}, nil
+}
+
+// Name implements KeyStore.
+func (g *gcpKMSKeyStore) Name() KeyStoreURIScheme { return KeyStoreGCPKMS }
+
+// CreateKey implements KeyStore, creating a new asymmetric-sign crypto
+// key and returning a reference to its primary version.
+func (g *gcpKMSKeyStore) CreateKey() ([]byte, []byte, error) {
+	ctx := context.Background()
+	key, err := g.client.CreateCryptoKey(ctx, &kmspb.CreateCryptoKeyRequest{
+		Parent: g.keyRing,
+		CryptoKey: &kmspb.CryptoKey{
+			Purpose: g.purpose,
+			VersionTemplate: &kmspb.CryptoKeyVersionTemplate{
+				Algorithm: g.algo,
+			},
+		},
+	})
+	if err != nil {
+		return nil, nil, trace.Wrap(err)
+	}
+	versionName := key.Name + "/cryptoKeyVersions/1"
+	pub, err := g.publicKeyPEM(versionName)
+	if err != nil {
+		return nil, nil, trace.Wrap(err)
+	}
+	ref := []byte(string(KeyStoreGCPKMS) + ":" + versionName)
+	return ref, pub, nil
+}
+
+// Signer implements KeyStore.
+func (g *gcpKMSKeyStore) Signer(ref []byte) (crypto.Signer, error) {
+	_, versionName, err := ParseKeyStoreURI(string(ref))
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	pub, err := g.publicKey(versionName)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return &gcpKMSSigner{client: g.client, versionName: versionName, public: pub}, nil
+}
+
+// DeleteKey implements KeyStore by scheduling the key version for
+// destruction.
+func (g *gcpKMSKeyStore) DeleteKey(ref []byte) error {
+	_, versionName, err := ParseKeyStoreURI(string(ref))
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	_, err = g.client.DestroyCryptoKeyVersion(context.Background(), &kmspb.DestroyCryptoKeyVersionRequest{
+		Name: versionName,
+	})
+	return trace.Wrap(err)
+}
+
+func (g *gcpKMSKeyStore) publicKey(versionName string) (crypto.PublicKey, error) {
+	resp, err := g.client.GetPublicKey(context.Background(), &kmspb.GetPublicKeyRequest{Name: versionName})
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	pub, err := parsePEMPublicKey([]byte(resp.Pem))
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return pub, nil
+}
+
+func (g *gcpKMSKeyStore) publicKeyPEM(versionName string) ([]byte, error) {
+	resp, err := g.client.GetPublicKey(context.Background(), &kmspb.GetPublicKeyRequest{Name: versionName})
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return []byte(resp.Pem), nil
+}
+
+// gcpKMSSigner implements crypto.Signer via the KMS AsymmetricSign API.
+type gcpKMSSigner struct {
+	client      *kms.KeyManagementClient
+	versionName string
+	public      crypto.PublicKey
+}
+
+// Public implements crypto.Signer.
+func (s *gcpKMSSigner) Public() crypto.PublicKey {
+	return s.public
+}
+
+// Sign implements crypto.Signer.
+func (s *gcpKMSSigner) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if opts.HashFunc() != crypto.SHA256 {
+		return nil, trace.BadParameter("unsupported hash function %v for GCP KMS signing", opts.HashFunc())
+	}
+	resp, err := s.client.AsymmetricSign(context.Background(), &kmspb.AsymmetricSignRequest{
+		Name:   s.versionName,
+		Digest: &kmspb.Digest{Digest: &kmspb.Digest_Sha256{Sha256: digest}},
+	})
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return resp.Signature, nil
+}
+
+// parsePEMPublicKey parses a PEM-encoded SubjectPublicKeyInfo, the format
+// KMS's GetPublicKey returns and the KeyStore implementations return from
+// CreateKey.
+func parsePEMPublicKey(pemBytes []byte) (crypto.PublicKey, error) {
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return nil, trace.BadParameter("failed to decode PEM public key")
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return pub, nil
+}
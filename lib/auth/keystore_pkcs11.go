@@ -0,0 +1,118 @@
+// +build pkcs11
+
+/*
+Copyright 2019 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"crypto"
+	"fmt"
+
+	"github.com/gravitational/trace"
+	"github.com/miekg/pkcs11"
+)
+
+// PKCS11Config configures access to an HSM reachable over PKCS#11.
+type PKCS11Config struct {
+	// Path is the filesystem path to the vendor's PKCS#11 shared library.
+	Path string
+	// TokenLabel identifies the token (slot) to use on the HSM.
+	TokenLabel string
+	// Pin authenticates to the token.
+	Pin string
+}
+
+// pkcs11KeyStore is a KeyStore backed by an HSM reachable over PKCS#11.
+// CA private keys never leave the HSM; only a reference to the key
+// object is persisted in the CA resource.
+type pkcs11KeyStore struct {
+	ctx     *pkcs11.Ctx
+	session pkcs11.SessionHandle
+}
+
+// NewPKCS11KeyStore opens a session against the configured PKCS#11 token
+// and returns a KeyStore that generates and signs with keys held there.
+func NewPKCS11KeyStore(cfg PKCS11Config) (KeyStore, error) {
+	ctx := pkcs11.New(cfg.Path)
+	if ctx == nil {
+		return nil, trace.BadParameter("failed to load PKCS#11 module at %v", cfg.Path)
+	}
+	if err := ctx.Initialize(); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	slot, err := findSlotByTokenLabel(ctx, cfg.TokenLabel)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	session, err := ctx.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION|pkcs11.CKF_RW_SESSION)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	if err := ctx.Login(session, pkcs11.CKU_USER, cfg.Pin); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return &pkcs11KeyStore{ctx: ctx, session: session}, nil
+}
+
+// Name implements KeyStore.
+func (p *pkcs11KeyStore) Name() KeyStoreURIScheme { return KeyStorePKCS11 }
+
+// CreateKey implements KeyStore, generating an RSA key pair on the token
+// and returning a reference of the form "pkcs11:object=<label>".
+func (p *pkcs11KeyStore) CreateKey() ([]byte, []byte, error) {
+	label := uuidObjectLabel()
+	pubTemplate, privTemplate := rsaKeyPairTemplate(label)
+	pubHandle, _, err := p.ctx.GenerateKeyPair(p.session,
+		[]*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS_KEY_PAIR_GEN, nil)},
+		pubTemplate, privTemplate)
+	if err != nil {
+		return nil, nil, trace.Wrap(err)
+	}
+	pub, err := marshalPublicKey(p.ctx, p.session, pubHandle)
+	if err != nil {
+		return nil, nil, trace.Wrap(err)
+	}
+	ref := []byte(fmt.Sprintf("%v:object=%v", KeyStorePKCS11, label))
+	return ref, pub, nil
+}
+
+// Signer implements KeyStore, returning a crypto.Signer that delegates
+// every Sign() call to the HSM via C_Sign.
+func (p *pkcs11KeyStore) Signer(ref []byte) (crypto.Signer, error) {
+	_, label, err := ParseKeyStoreURI(string(ref))
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	handle, pub, err := findKeyPairByLabel(p.ctx, p.session, objectLabelValue(label))
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return &pkcs11Signer{ctx: p.ctx, session: p.session, handle: handle, public: pub}, nil
+}
+
+// DeleteKey implements KeyStore.
+func (p *pkcs11KeyStore) DeleteKey(ref []byte) error {
+	_, label, err := ParseKeyStoreURI(string(ref))
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	handle, _, err := findKeyPairByLabel(p.ctx, p.session, objectLabelValue(label))
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	return trace.Wrap(p.ctx.DestroyObject(p.session, handle))
+}
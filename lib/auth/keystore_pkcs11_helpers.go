@@ -0,0 +1,202 @@
+// +build pkcs11
+
+/*
+Copyright 2019 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"strings"
+
+	"github.com/gravitational/trace"
+	"github.com/pborman/uuid"
+
+	"github.com/miekg/pkcs11"
+)
+
+// uuidObjectLabel generates a fresh, collision-resistant CKA_LABEL for a
+// new key pair object.
+func uuidObjectLabel() string {
+	return "teleport-" + uuid.New()
+}
+
+// objectLabelValue extracts the label from the "object=<label>" portion
+// of a parsed PKCS#11 key reference.
+func objectLabelValue(rest string) string {
+	return strings.TrimPrefix(rest, "object=")
+}
+
+// rsaKeyPairTemplate returns the CKA templates used to generate a 2048
+// bit RSA signing key pair with the given label.
+func rsaKeyPairTemplate(label string) ([]*pkcs11.Attribute, []*pkcs11.Attribute) {
+	pubTemplate := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_VERIFY, true),
+		pkcs11.NewAttribute(pkcs11.CKA_MODULUS_BITS, 2048),
+		pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, []byte{1, 0, 1}),
+	}
+	privTemplate := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_PRIVATE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_SIGN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, false),
+	}
+	return pubTemplate, privTemplate
+}
+
+// findSlotByTokenLabel looks up the slot ID for the token with the given
+// label.
+func findSlotByTokenLabel(ctx *pkcs11.Ctx, label string) (uint, error) {
+	slots, err := ctx.GetSlotList(true)
+	if err != nil {
+		return 0, trace.Wrap(err)
+	}
+	for _, slot := range slots {
+		info, err := ctx.GetTokenInfo(slot)
+		if err != nil {
+			continue
+		}
+		if strings.TrimRight(info.Label, "\x00 ") == label {
+			return slot, nil
+		}
+	}
+	return 0, trace.NotFound("no PKCS#11 token found with label %q", label)
+}
+
+// findKeyPairByLabel finds the private key object and parses the public
+// key sharing the given CKA_LABEL.
+func findKeyPairByLabel(ctx *pkcs11.Ctx, session pkcs11.SessionHandle, label string) (pkcs11.ObjectHandle, *rsa.PublicKey, error) {
+	template := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY),
+	}
+	if err := ctx.FindObjectsInit(session, template); err != nil {
+		return 0, nil, trace.Wrap(err)
+	}
+	handles, _, err := ctx.FindObjects(session, 1)
+	// Only one object search can be active per session, so this one is
+	// finished before the public key search below starts.
+	ctx.FindObjectsFinal(session)
+	if err != nil {
+		return 0, nil, trace.Wrap(err)
+	}
+	if len(handles) == 0 {
+		return 0, nil, trace.NotFound("no PKCS#11 private key found with label %q", label)
+	}
+
+	pubTemplate := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PUBLIC_KEY),
+	}
+	if err := ctx.FindObjectsInit(session, pubTemplate); err != nil {
+		return 0, nil, trace.Wrap(err)
+	}
+	defer ctx.FindObjectsFinal(session)
+	pubHandles, _, err := ctx.FindObjects(session, 1)
+	if err != nil {
+		return 0, nil, trace.Wrap(err)
+	}
+	if len(pubHandles) == 0 {
+		return 0, nil, trace.NotFound("no PKCS#11 public key found with label %q", label)
+	}
+	pub, err := parseRSAPublicKey(ctx, session, pubHandles[0])
+	if err != nil {
+		return 0, nil, trace.Wrap(err)
+	}
+	return handles[0], pub, nil
+}
+
+// parseRSAPublicKey reads CKA_MODULUS/CKA_PUBLIC_EXPONENT off a public
+// key object and assembles an *rsa.PublicKey.
+func parseRSAPublicKey(ctx *pkcs11.Ctx, session pkcs11.SessionHandle, handle pkcs11.ObjectHandle) (*rsa.PublicKey, error) {
+	attrs, err := ctx.GetAttributeValue(session, handle, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_MODULUS, nil),
+		pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, nil),
+	})
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	n := new(big.Int).SetBytes(attrs[0].Value)
+	e := new(big.Int).SetBytes(attrs[1].Value)
+	return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+}
+
+// marshalPublicKey reads the public key off the HSM and returns it PEM
+// encoded, matching the format used for inline CA checking keys.
+func marshalPublicKey(ctx *pkcs11.Ctx, session pkcs11.SessionHandle, handle pkcs11.ObjectHandle) ([]byte, error) {
+	pub, err := parseRSAPublicKey(ctx, session, handle)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), nil
+}
+
+// pkcs11Signer implements crypto.Signer by delegating Sign() to the HSM
+// via C_Sign, keeping the private key material on the token at all
+// times.
+type pkcs11Signer struct {
+	ctx     *pkcs11.Ctx
+	session pkcs11.SessionHandle
+	handle  pkcs11.ObjectHandle
+	public  *rsa.PublicKey
+}
+
+// Public implements crypto.Signer.
+func (s *pkcs11Signer) Public() crypto.PublicKey {
+	return s.public
+}
+
+// Sign implements crypto.Signer, signing a pre-hashed digest on the HSM.
+func (s *pkcs11Signer) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	mechanism, err := pkcs11MechanismFor(opts)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	if err := s.ctx.SignInit(s.session, []*pkcs11.Mechanism{mechanism}, s.handle); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	sig, err := s.ctx.Sign(s.session, digest)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return sig, nil
+}
+
+// pkcs11MechanismFor maps a crypto.SignerOpts hash to the matching
+// PKCS#11 RSA PKCS#1 v1.5 mechanism.
+func pkcs11MechanismFor(opts crypto.SignerOpts) (*pkcs11.Mechanism, error) {
+	switch opts.HashFunc() {
+	case crypto.SHA256:
+		return pkcs11.NewMechanism(pkcs11.CKM_SHA256_RSA_PKCS, nil), nil
+	case crypto.SHA512:
+		return pkcs11.NewMechanism(pkcs11.CKM_SHA512_RSA_PKCS, nil), nil
+	default:
+		return nil, trace.BadParameter("unsupported hash function %v for PKCS#11 signing", opts.HashFunc())
+	}
+}
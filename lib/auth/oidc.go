@@ -17,6 +17,7 @@ limitations under the License.
 package auth
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -70,6 +71,9 @@ func (s *AuthServer) getOIDCClient(conn services.OIDCConnector) (*oidc.Client, e
 }
 
 func (s *AuthServer) UpsertOIDCConnector(connector services.OIDCConnector) error {
+	if err := validateOIDCClaimsTemplate(connector); err != nil {
+		return trace.Wrap(err)
+	}
 	return s.Identity.UpsertOIDCConnector(connector)
 }
 
@@ -182,7 +186,7 @@ func (a *AuthServer) validateOIDCAuthCallback(q url.Values) (*OIDCAuthResponse,
 	}
 
 	// extract claims from both the id token and the userinfo endpoint and merge them
-	claims, err := a.getClaims(oidcClient, connector.GetIssuerURL(), connector.GetScope(), code)
+	claims, refreshToken, err := a.getClaims(oidcClient, connector.GetIssuerURL(), connector.GetScope(), connector.GetProvider(), connector.GetUseGooglePeopleAPI(), code)
 	if err != nil {
 		return nil, trace.OAuth2(
 			oauth2.ErrorUnsupportedResponseType, "unable to construct claims", q)
@@ -212,10 +216,20 @@ func (a *AuthServer) validateOIDCAuthCallback(q url.Values) (*OIDCAuthResponse,
 		Req:      *req,
 	}
 
-	log.Debugf("Applying %v OIDC claims to roles mappings.", len(connector.GetClaimsToRoles()))
-	if len(connector.GetClaimsToRoles()) != 0 {
-		if err := a.createOIDCUser(connector, ident, claims); err != nil {
-			return nil, trace.Wrap(err)
+	usesClaimsMapping := len(connector.GetClaimsToRoles()) != 0 || connector.GetClaimsMappingMode() == oidcClaimsMappingModeTemplate
+	log.Debugf("Applying OIDC claims to roles mapping (mode=%q, static rules=%v).", connector.GetClaimsMappingMode(), len(connector.GetClaimsToRoles()))
+	if usesClaimsMapping {
+		switch a.getOIDCSessionMode(connector.GetName()) {
+		case OIDCSessionModeStatelessJWT:
+			sessionJWT, err := a.IssueOIDCSessionJWT(connector, ident, claims)
+			if err != nil {
+				return nil, trace.Wrap(err)
+			}
+			response.SessionJWT = sessionJWT
+		default:
+			if err := a.createOIDCUser(connector, ident, claims); err != nil {
+				return nil, trace.Wrap(err)
+			}
 		}
 	}
 
@@ -223,10 +237,52 @@ func (a *AuthServer) validateOIDCAuthCallback(q url.Values) (*OIDCAuthResponse,
 		return response, nil
 	}
 
-	user, err := a.Identity.GetUserByOIDCIdentity(services.ExternalIdentity{
-		ConnectorID: req.ConnectorID, Username: ident.Email})
-	if err != nil {
-		return nil, trace.Wrap(err)
+	// Stateless-JWT connectors never write a backend User, so there is
+	// nothing for GetUserByOIDCIdentity to find below; req.CheckUser
+	// should be false for those requests and callers should authenticate
+	// off response.SessionJWT instead.
+	//
+	// Try every verified email the Google People API reported for this
+	// account, not just the one that came back as this login's "email"
+	// claim, so a user record created under an alias Google no longer
+	// prefers is still found.
+	candidateEmails := []string{ident.Email}
+	if primary, allEmails := googleVerifiedEmailsFromClaims(claims); primary != "" {
+		seen := map[string]bool{ident.Email: true}
+		for _, email := range append([]string{primary}, allEmails...) {
+			if seen[email] {
+				continue
+			}
+			seen[email] = true
+			candidateEmails = append(candidateEmails, email)
+		}
+	}
+
+	var user services.User
+	var matchedEmail string
+	for _, email := range candidateEmails {
+		user, err = a.Identity.GetUserByOIDCIdentity(services.ExternalIdentity{
+			ConnectorID: req.ConnectorID, Username: email})
+		if err == nil {
+			matchedEmail = email
+			break
+		}
+		if !trace.IsNotFound(err) {
+			return nil, trace.Wrap(err)
+		}
+	}
+	if user == nil {
+		return nil, trace.NotFound("no Teleport user found for OIDC identity %v/%v", req.ConnectorID, ident.Email)
+	}
+	if matchedEmail != ident.Email {
+		log.Infof("OIDC user %q matched via Google alternate email %q instead of login email %q.",
+			user.GetName(), matchedEmail, ident.Email)
+		a.EmitAuditEvent(events.UserLoginEvent, events.EventFields{
+			events.EventUser:              user.GetName(),
+			events.LoginMethod:            events.LoginMethodOIDC,
+			"google_alternate_email":      matchedEmail,
+			"google_alternate_email_from": ident.Email,
+		})
 	}
 	response.Username = user.GetName()
 
@@ -251,6 +307,20 @@ func (a *AuthServer) validateOIDCAuthCallback(q url.Values) (*OIDCAuthResponse,
 			return nil, trace.Wrap(err)
 		}
 		response.Session = sess
+
+		// Persist the refresh token, if the provider issued one, so the
+		// OIDC refresh reconciler can keep this session's roles/traits in
+		// sync with the IdP without waiting for the user to rerun SSO.
+		if refreshToken != "" {
+			if err := a.Identity.UpsertOIDCRefreshToken(services.OIDCRefreshToken{
+				Username:     user.GetName(),
+				ConnectorID:  connector.GetName(),
+				RefreshToken: refreshToken,
+				ExpiresAt:    a.clock.Now().UTC().Add(sessionTTL),
+			}); err != nil {
+				return nil, trace.Wrap(err)
+			}
+		}
 	}
 
 	if len(req.PublicKey) != 0 {
@@ -299,18 +369,46 @@ type OIDCAuthResponse struct {
 	// HostSigners is a list of signing host public keys
 	// trusted by proxy, used in console login
 	HostSigners []services.CertAuthority `json:"host_signers"`
+	// SessionJWT is set instead of a backend User record being created
+	// when the connector is configured for OIDCSessionModeStatelessJWT.
+	SessionJWT string `json:"session_jwt,omitempty"`
 }
 
-// buildOIDCRoles takes a connector and claims and returns a slice of roles.
-func (a *AuthServer) buildOIDCRoles(connector services.OIDCConnector, claims jose.Claims) ([]string, error) {
-	roles := connector.MapClaims(claims)
+// claimsToRolesMapper is satisfied by every connector type whose
+// ClaimsToRoles mapping drives role assignment from a flat set of
+// claims, currently services.OIDCConnector and services.OAuth2Connector.
+// Sharing it lets rolesFromClaims back both SSO flows identically.
+type claimsToRolesMapper interface {
+	MapClaims(claims jose.Claims) []string
+	GetName() string
+}
+
+// rolesFromClaims maps claims to roles via mapper's ClaimsToRoles rules.
+func rolesFromClaims(mapper claimsToRolesMapper, claims jose.Claims) ([]string, error) {
+	roles := mapper.MapClaims(claims)
 	if len(roles) == 0 {
-		return nil, trace.AccessDenied("unable to map claims to role for connector: %v", connector.GetName())
+		return nil, trace.AccessDenied("unable to map claims to role for connector: %v", mapper.GetName())
 	}
 
 	return roles, nil
 }
 
+// buildOIDCRoles takes a connector and claims and returns a slice of
+// roles, along with any trait overrides produced along the way. Trait
+// overrides are only ever non-nil for a connector in
+// OIDCClaimsMappingModeTemplate; the default static ClaimsToRoles mode
+// only ever produces roles, leaving traits to claimsToTraitMap.
+func (a *AuthServer) buildOIDCRoles(connector services.OIDCConnector, claims jose.Claims) ([]string, map[string][]string, error) {
+	if connector.GetClaimsMappingMode() == oidcClaimsMappingModeTemplate {
+		return evaluateOIDCClaimsTemplate(connector.GetClaimsTemplate(), claims)
+	}
+	roles, err := rolesFromClaims(connector, claims)
+	if err != nil {
+		return nil, nil, err
+	}
+	return roles, nil, nil
+}
+
 // claimsToTraitMap extracts all string claims and creates a map of traits
 // that can be used to populate role variables.
 func claimsToTraitMap(claims jose.Claims) map[string][]string {
@@ -331,38 +429,72 @@ func claimsToTraitMap(claims jose.Claims) map[string][]string {
 }
 
 func (a *AuthServer) createOIDCUser(connector services.OIDCConnector, ident *oidc.Identity, claims jose.Claims) error {
-	roles, err := a.buildOIDCRoles(connector, claims)
+	roles, templateTraits, err := a.buildOIDCRoles(connector, claims)
 	if err != nil {
 		return trace.Wrap(err)
 	}
 
 	traits := claimsToTraitMap(claims)
+	for k, v := range templateTraits {
+		traits[k] = v
+	}
+
+	// Google's People API may report verified alternate email addresses
+	// for this account; prefer the one it calls primary as the Teleport
+	// username, and record every verified address as an OIDCIdentity so
+	// a later login under any of them still resolves to this user.
+	username := ident.Email
+	identities := []services.ExternalIdentity{{ConnectorID: connector.GetName(), Username: ident.Email}}
+	if primary, allEmails := googleVerifiedEmailsFromClaims(claims); primary != "" {
+		username = primary
+		identities = identities[:0]
+		seen := make(map[string]bool, len(allEmails)+1)
+		for _, email := range append([]string{primary}, allEmails...) {
+			if seen[email] {
+				continue
+			}
+			seen[email] = true
+			identities = append(identities, services.ExternalIdentity{ConnectorID: connector.GetName(), Username: email})
+		}
+	}
+
+	patch, err := a.invokeOIDCLoginWebhooks(connector, oidcWebhookPayload{
+		ConnectorID: connector.GetName(),
+		Username:    username,
+		Roles:       roles,
+		Identity:    services.ExternalIdentity{ConnectorID: connector.GetName(), Username: username},
+		Claims:      claims,
+	})
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	if patch != nil {
+		roles = append(roles, patch.Roles...)
+		for k, v := range patch.Traits {
+			traits[k] = v
+		}
+	}
 
-	log.Debugf("Generating dynamic OIDC identity %v/%v with roles: %v.", connector.GetName(), ident.Email, roles)
+	log.Debugf("Generating dynamic OIDC identity %v/%v with roles: %v.", connector.GetName(), username, roles)
 	user, err := services.GetUserMarshaler().GenerateUser(&services.UserV2{
 		Kind:    services.KindUser,
 		Version: services.V2,
 		Metadata: services.Metadata{
-			Name:      ident.Email,
+			Name:      username,
 			Namespace: defaults.Namespace,
 		},
 		Spec: services.UserSpecV2{
-			Roles:   roles,
-			Traits:  traits,
-			Expires: ident.ExpiresAt,
-			OIDCIdentities: []services.ExternalIdentity{
-				{
-					ConnectorID: connector.GetName(),
-					Username:    ident.Email,
-				},
-			},
+			Roles:          roles,
+			Traits:         traits,
+			Expires:        ident.ExpiresAt,
+			OIDCIdentities: identities,
 			CreatedBy: services.CreatedBy{
 				User: services.UserRef{Name: "system"},
 				Time: time.Now().UTC(),
 				Connector: &services.ConnectorRef{
 					Type:     teleport.ConnectorOIDC,
 					ID:       connector.GetName(),
-					Identity: ident.Email,
+					Identity: username,
 				},
 			},
 		},
@@ -372,7 +504,7 @@ func (a *AuthServer) createOIDCUser(connector services.OIDCConnector, ident *oid
 	}
 
 	// Get the user to check if it already exists or not.
-	existingUser, err := a.GetUser(ident.Email)
+	existingUser, err := a.GetUser(username)
 	if err != nil {
 		if !trace.IsNotFound(err) {
 			return trace.Wrap(err)
@@ -527,35 +659,13 @@ type gsuiteClient struct {
 // fetchGroups fetches GSuite groups a user belongs to and returns
 // "groups" claim with
 func (g *gsuiteClient) fetchGroups() (jose.Claims, error) {
-	count := 0
-	var groups []string
-	var nextPageToken string
-collect:
-	for {
-		if count > MaxPages {
-			warningMessage := "Truncating list of teams used to populate claims: " +
-				"hit maximum number pages that can be fetched from GSuite."
-
-			// Print warning to Teleport logs as well as the Audit Log.
-			log.Warnf(warningMessage)
-			g.auditLog.EmitAuditEvent(events.UserLoginEvent, events.EventFields{
-				events.LoginMethod:        events.LoginMethodOIDC,
-				events.AuthAttemptMessage: warningMessage,
-			})
-			break collect
-		}
-		response, err := g.fetchGroupsPage(nextPageToken)
+	return fetchAllGroups(g.auditLog, "GSuite", func(pageToken string) ([]string, string, error) {
+		response, err := g.fetchGroupsPage(pageToken)
 		if err != nil {
-			return nil, trace.Wrap(err)
+			return nil, "", trace.Wrap(err)
 		}
-		groups = append(groups, response.groups()...)
-		if response.NextPageToken == "" {
-			break collect
-		}
-		count++
-		nextPageToken = response.NextPageToken
-	}
-	return jose.Claims{"groups": groups}, nil
+		return response.groups(), response.NextPageToken, nil
+	})
 }
 
 func (g *gsuiteClient) fetchGroupsPage(pageToken string) (*gsuiteGroups, error) {
@@ -627,24 +737,26 @@ func mergeClaims(a jose.Claims, b jose.Claims) (jose.Claims, error) {
 	return a, nil
 }
 
-// getClaims gets claims from ID token and UserInfo and returns UserInfo claims merged into ID token claims.
-func (a *AuthServer) getClaims(oidcClient *oidc.Client, issuerURL string, scope []string, code string) (jose.Claims, error) {
+// getClaims gets claims from ID token and UserInfo and returns UserInfo claims merged into ID token claims,
+// along with the refresh token issued alongside them, if any, so the caller can keep the identity fresh
+// via refreshOIDCClaims without waiting for the user to rerun SSO.
+func (a *AuthServer) getClaims(oidcClient *oidc.Client, issuerURL string, scope []string, provider string, useGooglePeopleAPI bool, code string) (jose.Claims, string, error) {
 	var err error
 
 	oac, err := oidcClient.OAuthClient()
 	if err != nil {
-		return nil, trace.Wrap(err)
+		return nil, "", trace.Wrap(err)
 	}
 
 	t, err := oac.RequestToken(oauth2.GrantTypeAuthCode, code)
 	if err != nil {
-		return nil, trace.Wrap(err)
+		return nil, "", trace.Wrap(err)
 	}
 
 	idTokenClaims, err := claimsFromIDToken(oidcClient, t.IDToken)
 	if err != nil {
 		log.Debugf("Unable to fetch OIDC ID token claims: %v.", err)
-		return nil, trace.Wrap(err)
+		return nil, "", trace.Wrap(err)
 	}
 	log.Debugf("OIDC ID Token claims: %v.", idTokenClaims)
 
@@ -652,10 +764,10 @@ func (a *AuthServer) getClaims(oidcClient *oidc.Client, issuerURL string, scope
 	if err != nil {
 		if trace.IsNotFound(err) {
 			log.Debugf("OIDC provider doesn't offer UserInfo endpoint. Returning token claims: %v.", idTokenClaims)
-			return idTokenClaims, nil
+			return idTokenClaims, t.RefreshToken, nil
 		}
 		log.Debugf("Unable to fetch UserInfo claims: %v.", err)
-		return nil, trace.Wrap(err)
+		return nil, "", trace.Wrap(err)
 	}
 	log.Debugf("UserInfo claims: %v.", userInfoClaims)
 
@@ -667,48 +779,65 @@ func (a *AuthServer) getClaims(oidcClient *oidc.Client, issuerURL string, scope
 	var exists bool
 	if idsub, exists, err = idTokenClaims.StringClaim("sub"); err != nil || !exists {
 		log.Debugf("Unable to extract OIDC sub claim from ID token.")
-		return nil, trace.Wrap(err)
+		return nil, "", trace.Wrap(err)
 	}
 	if uisub, exists, err = userInfoClaims.StringClaim("sub"); err != nil || !exists {
 		log.Debugf("Unable to extract OIDC sub claim from UserInfo.")
-		return nil, trace.Wrap(err)
+		return nil, "", trace.Wrap(err)
 	}
 	if idsub != uisub {
 		log.Debugf("OIDC claim subjects don't match '%v' != '%v'.", idsub, uisub)
-		return nil, trace.BadParameter("invalid subject in UserInfo")
+		return nil, "", trace.BadParameter("invalid subject in UserInfo")
 	}
 
 	claims, err := mergeClaims(idTokenClaims, userInfoClaims)
 	if err != nil {
 		log.Debugf("Unable to merge OIDC claims: %v.", err)
-		return nil, trace.Wrap(err)
+		return nil, "", trace.Wrap(err)
 	}
 
-	// for GSuite users, fetch extra data from the proprietary google API
-	// only if scope includes admin groups readonly scope
-	if issuerURL == teleport.GSuiteIssuerURL && utils.SliceContainsStr(scope, teleport.GSuiteGroupsScope) {
-		email, _, err := claims.StringClaim("email")
+	// fetch group membership from whichever backend is registered for
+	// this connector's provider (GSuite, Azure AD, Okta, GitLab, ...)
+	// and merge it in as a "groups" claim.
+	email, _, err := claims.StringClaim("email")
+	if err != nil {
+		return nil, "", trace.Wrap(err)
+	}
+	groupsClaims, configured, err := a.fetchProviderGroups(context.TODO(), oidcClient, issuerURL, provider, scope, t.AccessToken, email)
+	if err != nil {
+		if !trace.IsNotFound(err) {
+			return nil, "", trace.Wrap(err)
+		}
+		log.Debugf("Found no group claims for provider %q.", provider)
+	} else if configured {
+		log.Debugf("Got group claims: %v.", groupsClaims)
+		claims, err = mergeClaims(claims, groupsClaims)
 		if err != nil {
-			return nil, trace.Wrap(err)
+			return nil, "", trace.Wrap(err)
 		}
-		gsuiteClaims, err := a.claimsFromGSuite(oidcClient, issuerURL, email, t.AccessToken)
+	}
+
+	// for Google accounts, optionally enrich claims with every verified
+	// email address on the account via the People API, so a user whose
+	// "email" claim has switched aliases since their Teleport user was
+	// created can still be recognized.
+	if issuerURL == teleport.GSuiteIssuerURL && useGooglePeopleAPI {
+		verifiedEmails, err := a.fetchGoogleVerifiedEmails(oidcClient, t.AccessToken)
 		if err != nil {
 			if !trace.IsNotFound(err) {
-				return nil, trace.Wrap(err)
+				return nil, "", trace.Wrap(err)
 			}
-			log.Debugf("Found no GSuite claims.")
+			log.Debugf("Found no Google People API verified emails.")
 		} else {
-			if gsuiteClaims != nil {
-				log.Debugf("Got GSuiteclaims: %v.", gsuiteClaims)
-			}
-			claims, err = mergeClaims(claims, gsuiteClaims)
-			if err != nil {
-				return nil, trace.Wrap(err)
+			log.Debugf("Got %v Google People API verified email(s), primary %q.", len(verifiedEmails.All), verifiedEmails.Primary)
+			claims["google_verified_emails"] = verifiedEmails.All
+			if verifiedEmails.Primary != "" {
+				claims["google_primary_email"] = verifiedEmails.Primary
 			}
 		}
 	}
 
-	return claims, nil
+	return claims, t.RefreshToken, nil
 }
 
 // validateACRValues validates that we get an appropriate response for acr values. By default
@@ -0,0 +1,147 @@
+/*
+Copyright 2019 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"path/filepath"
+	"time"
+
+	"github.com/gravitational/teleport"
+	"github.com/gravitational/teleport/lib/events"
+	"github.com/gravitational/teleport/lib/srv/adminsock"
+
+	"github.com/gravitational/trace"
+)
+
+// DefaultAdminSocketName is the socket file Init creates under DataDir
+// when InitConfig.AdminSocketPath is left empty.
+const DefaultAdminSocketName = "auth-admin.sock"
+
+// verbListOIDCUsers and verbExpireOIDCUser are the adminsock verbs this
+// file registers. Other subsystems register their own verbs on the same
+// Registry under their own names.
+const (
+	verbListOIDCUsers  = "list-oidc-users"
+	verbExpireOIDCUser = "expire-oidc-user"
+)
+
+// oidcUserInfo is the listOIDCUsers result for a single ephemeral user,
+// read straight off the backend User record createOIDCUser wrote.
+type oidcUserInfo struct {
+	// Username is the Teleport username, the OIDC identity's email.
+	Username string `json:"username"`
+	// ConnectorName is the OIDC connector that created this user.
+	ConnectorName string `json:"connector_name"`
+	// Roles are the roles mapped from the connector's ClaimsToRoles.
+	Roles []string `json:"roles"`
+	// Claims are the source OIDC claims recorded as traits.
+	Claims map[string][]string `json:"claims"`
+	// IssuedAt is when createOIDCUser wrote this record.
+	IssuedAt time.Time `json:"issued_at"`
+	// ExpiresAt is the backend TTL expiry; the record disappears at this
+	// time without any call to expire-oidc-user.
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// registerOIDCAdminHandlers adds the list-oidc-users and expire-oidc-user
+// verbs to registry.
+func (a *AuthServer) registerOIDCAdminHandlers(registry *adminsock.Registry) {
+	registry.Register(verbListOIDCUsers, a.handleListOIDCUsers)
+	registry.Register(verbExpireOIDCUser, a.handleExpireOIDCUser)
+}
+
+// handleListOIDCUsers implements the list-oidc-users verb.
+func (a *AuthServer) handleListOIDCUsers(args []string) (interface{}, error) {
+	users, err := a.GetUsers()
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	var result []oidcUserInfo
+	for _, user := range users {
+		connectorRef := user.GetCreatedBy().Connector
+		if connectorRef == nil || connectorRef.Type != teleport.ConnectorOIDC {
+			continue
+		}
+		result = append(result, oidcUserInfo{
+			Username:      user.GetName(),
+			ConnectorName: connectorRef.ID,
+			Roles:         user.GetRoles(),
+			Claims:        user.GetTraits(),
+			IssuedAt:      user.GetCreatedBy().Time,
+			ExpiresAt:     user.Expiry(),
+		})
+	}
+	return result, nil
+}
+
+// handleExpireOIDCUser implements the expire-oidc-user verb: it deletes
+// the named user immediately, ahead of its backend TTL, and audits the
+// early expiry.
+func (a *AuthServer) handleExpireOIDCUser(args []string) (interface{}, error) {
+	if len(args) != 1 || args[0] == "" {
+		return nil, trace.BadParameter("expire-oidc-user requires exactly one argument: the username")
+	}
+	username := args[0]
+
+	user, err := a.GetUser(username)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	connectorRef := user.GetCreatedBy().Connector
+	if connectorRef == nil || connectorRef.Type != teleport.ConnectorOIDC {
+		return nil, trace.BadParameter("%v is not an OIDC-created user", username)
+	}
+
+	if err := a.DeleteUser(username); err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	a.EmitAuditEvent(events.OIDCUserExpiredEvent, events.EventFields{
+		events.EventUser: username,
+		"connector_name": connectorRef.ID,
+	})
+	log.Infof("Admin socket: expired OIDC user %v (connector %v) ahead of its TTL.", username, connectorRef.ID)
+	return map[string]string{"username": username}, nil
+}
+
+// startAdminSocket creates, registers, and starts serving the auth
+// server's admin RPC socket at cfg.AdminSocketPath (or its default under
+// cfg.DataDir). Callers gate this on cfg.SkipPeriodicOperations, the
+// same flag that disables runPeriodicOperations, so tests that don't
+// need the socket don't leave a stray file behind.
+func (a *AuthServer) startAdminSocket(cfg *InitConfig) (*adminsock.Server, error) {
+	path := cfg.AdminSocketPath
+	if path == "" {
+		path = filepath.Join(cfg.DataDir, DefaultAdminSocketName)
+	}
+
+	registry := adminsock.NewRegistry()
+	a.registerOIDCAdminHandlers(registry)
+
+	srv, err := adminsock.New(path, registry)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	go func() {
+		if err := srv.Serve(); err != nil {
+			log.Warningf("Admin socket stopped serving: %v.", err)
+		}
+	}()
+	log.Infof("Auth server listening for admin RPCs on %v.", path)
+	return srv, nil
+}
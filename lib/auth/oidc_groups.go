@@ -0,0 +1,397 @@
+/*
+Copyright 2019 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gravitational/teleport"
+	"github.com/gravitational/teleport/lib/events"
+	"github.com/gravitational/teleport/lib/utils"
+
+	"github.com/coreos/go-oidc/jose"
+	"github.com/coreos/go-oidc/oidc"
+	"github.com/gravitational/trace"
+)
+
+// Provider identifiers accepted as an OIDCConnector's Provider field, used
+// to pick which GroupsProvider fetches that connector's group memberships.
+const (
+	ProviderGSuite = "gsuite"
+	ProviderAzure  = "azure"
+	ProviderOkta   = "okta"
+	ProviderGitLab = "gitlab"
+)
+
+// GroupsProvider fetches the groups a user belongs to from a third-party
+// directory API, returning them as a "groups" claim to be merged into the
+// rest of the OIDC claims. Implementations are registered in
+// groupsProviders under the Provider identifier getClaims and
+// refreshOIDCClaims dispatch on.
+type GroupsProvider interface {
+	// FetchGroups fetches the group memberships of the account identified by
+	// email, using accessToken to authenticate to the provider's API.
+	FetchGroups(ctx context.Context, oidcClient *oidc.Client, accessToken string, email string) (jose.Claims, error)
+}
+
+// groupsProviders maps a connector's Provider identifier to a constructor
+// for the GroupsProvider that knows how to fetch its groups.
+var groupsProviders = map[string]func(a *AuthServer, issuerURL string) GroupsProvider{
+	ProviderGSuite: func(a *AuthServer, issuerURL string) GroupsProvider {
+		return gsuiteGroupsProvider{authServer: a, issuerURL: issuerURL}
+	},
+	ProviderAzure: func(a *AuthServer, issuerURL string) GroupsProvider {
+		return azureGroupsProvider{authServer: a}
+	},
+	ProviderOkta: func(a *AuthServer, issuerURL string) GroupsProvider {
+		return oktaGroupsProvider{authServer: a, issuerURL: issuerURL}
+	},
+	ProviderGitLab: func(a *AuthServer, issuerURL string) GroupsProvider {
+		return gitlabGroupsProvider{authServer: a, issuerURL: issuerURL}
+	},
+}
+
+// fetchProviderGroups looks up the GroupsProvider registered for provider
+// and uses it to fetch email's group memberships. provider is normally
+// connector.GetProvider(), but an empty provider on a connector whose
+// issuer and scope match the old GSuite detection is treated as
+// ProviderGSuite, so connectors created before Provider existed keep
+// working unchanged. configured is false when there's no provider to
+// dispatch to, which callers should treat as "nothing to fetch" rather
+// than an error.
+func (a *AuthServer) fetchProviderGroups(ctx context.Context, oidcClient *oidc.Client, issuerURL string, provider string, scope []string, accessToken string, email string) (claims jose.Claims, configured bool, err error) {
+	if provider == "" && issuerURL == teleport.GSuiteIssuerURL && utils.SliceContainsStr(scope, teleport.GSuiteGroupsScope) {
+		provider = ProviderGSuite
+	}
+	if provider == "" {
+		return nil, false, nil
+	}
+
+	newProvider, ok := groupsProviders[provider]
+	if !ok {
+		return nil, false, trace.BadParameter("unsupported groups provider %q", provider)
+	}
+
+	claims, err = newProvider(a, issuerURL).FetchGroups(ctx, oidcClient, accessToken, email)
+	return claims, true, trace.Wrap(err)
+}
+
+// groupsPageFetcher fetches one page of group names for a user, given the
+// pagination token returned by the previous page ("" for the first page),
+// and returns the token for the following page ("" when there isn't one).
+type groupsPageFetcher func(pageToken string) (groups []string, nextPageToken string, err error)
+
+// fetchAllGroups drives a groupsPageFetcher until it runs out of pages or
+// hits MaxPages, merging every page's groups into a single "groups" claim.
+// Hitting MaxPages isn't treated as an error: it's logged and raised as an
+// audit warning, and whatever groups were already collected are returned
+// anyway. This is the pagination behavior GSuite group fetching has always
+// had, generalized so every GroupsProvider gets it for free.
+func fetchAllGroups(auditLog events.IAuditLog, providerName string, fetch groupsPageFetcher) (jose.Claims, error) {
+	count := 0
+	var groups []string
+	var nextPageToken string
+collect:
+	for {
+		if count > MaxPages {
+			warningMessage := fmt.Sprintf("Truncating list of groups used to populate claims: "+
+				"hit maximum number pages that can be fetched from %v.", providerName)
+
+			// Print warning to Teleport logs as well as the Audit Log.
+			log.Warnf(warningMessage)
+			auditLog.EmitAuditEvent(events.UserLoginEvent, events.EventFields{
+				events.LoginMethod:        events.LoginMethodOIDC,
+				events.AuthAttemptMessage: warningMessage,
+			})
+			break collect
+		}
+		page, next, err := fetch(nextPageToken)
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+		groups = append(groups, page...)
+		if next == "" {
+			break collect
+		}
+		count++
+		nextPageToken = next
+	}
+	return jose.Claims{"groups": groups}, nil
+}
+
+// gsuiteGroupsProvider adapts the existing GSuite Admin SDK client to the
+// GroupsProvider interface.
+type gsuiteGroupsProvider struct {
+	authServer *AuthServer
+	issuerURL  string
+}
+
+func (p gsuiteGroupsProvider) FetchGroups(ctx context.Context, oidcClient *oidc.Client, accessToken string, email string) (jose.Claims, error) {
+	return p.authServer.claimsFromGSuite(oidcClient, p.issuerURL, email, accessToken)
+}
+
+// azureGraphMemberOfEndpoint is the Microsoft Graph endpoint listing the
+// signed-in user's group memberships. It's always graph.microsoft.com
+// regardless of tenant, unlike the Okta and GitLab APIs below.
+const azureGraphMemberOfEndpoint = "https://graph.microsoft.com/v1.0/me/memberOf?$select=displayName,id"
+
+// azureGroupsProvider fetches group memberships from Microsoft Graph's
+// /me/memberOf, following @odata.nextLink for pagination.
+type azureGroupsProvider struct {
+	authServer *AuthServer
+}
+
+type azureGroupsPage struct {
+	NextLink string              `json:"@odata.nextLink"`
+	Value    []azureGroupsMember `json:"value"`
+}
+
+type azureGroupsMember struct {
+	ID          string `json:"id"`
+	DisplayName string `json:"displayName"`
+}
+
+func (p azureGroupsProvider) FetchGroups(ctx context.Context, oidcClient *oidc.Client, accessToken string, email string) (jose.Claims, error) {
+	oac, err := oidcClient.OAuthClient()
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	httpClient := oac.HttpClient()
+
+	return fetchAllGroups(p.authServer, "Azure AD", func(pageToken string) ([]string, string, error) {
+		endpoint := azureGraphMemberOfEndpoint
+		if pageToken != "" {
+			// @odata.nextLink is already a complete, ready-to-call URL.
+			endpoint = pageToken
+		}
+
+		log.Debugf("Fetching OIDC claims from Microsoft Graph endpoint: %q.", endpoint)
+
+		req, err := http.NewRequest("GET", endpoint, nil)
+		if err != nil {
+			return nil, "", trace.Wrap(err)
+		}
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", accessToken))
+
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			return nil, "", trace.Wrap(err)
+		}
+		defer resp.Body.Close()
+
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return nil, "", trace.Wrap(err)
+		}
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return nil, "", trace.AccessDenied("bad status code: %v %v", resp.StatusCode, string(body))
+		}
+
+		var page azureGroupsPage
+		if err := json.Unmarshal(body, &page); err != nil {
+			return nil, "", trace.BadParameter("failed to parse Microsoft Graph response: %v", err)
+		}
+
+		groups := make([]string, 0, len(page.Value))
+		for _, member := range page.Value {
+			name := member.DisplayName
+			if name == "" {
+				name = member.ID
+			}
+			groups = append(groups, name)
+		}
+		return groups, page.NextLink, nil
+	})
+}
+
+// oktaGroupsProvider fetches group memberships from Okta's
+// /api/v1/users/{idOrLogin}/groups, using the user's email as the login,
+// and follows the "next" Link header for pagination.
+type oktaGroupsProvider struct {
+	authServer *AuthServer
+	issuerURL  string
+}
+
+type oktaGroup struct {
+	Profile struct {
+		Name string `json:"name"`
+	} `json:"profile"`
+}
+
+func (p oktaGroupsProvider) FetchGroups(ctx context.Context, oidcClient *oidc.Client, accessToken string, email string) (jose.Claims, error) {
+	if err := isHTTPS(p.issuerURL); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	apiBase, err := apiBaseFromIssuer(p.issuerURL)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	oac, err := oidcClient.OAuthClient()
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	httpClient := oac.HttpClient()
+	endpoint := fmt.Sprintf("%v/api/v1/users/%v/groups", apiBase, url.PathEscape(email))
+
+	return fetchAllGroups(p.authServer, "Okta", func(pageToken string) ([]string, string, error) {
+		reqURL := endpoint
+		if pageToken != "" {
+			// the "next" Link header is already a complete, ready-to-call URL.
+			reqURL = pageToken
+		}
+
+		log.Debugf("Fetching OIDC claims from Okta groups endpoint: %q.", reqURL)
+
+		req, err := http.NewRequest("GET", reqURL, nil)
+		if err != nil {
+			return nil, "", trace.Wrap(err)
+		}
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", accessToken))
+
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			return nil, "", trace.Wrap(err)
+		}
+		defer resp.Body.Close()
+
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return nil, "", trace.Wrap(err)
+		}
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return nil, "", trace.AccessDenied("bad status code: %v %v", resp.StatusCode, string(body))
+		}
+
+		var page []oktaGroup
+		if err := json.Unmarshal(body, &page); err != nil {
+			return nil, "", trace.BadParameter("failed to parse Okta response: %v", err)
+		}
+
+		groups := make([]string, 0, len(page))
+		for _, group := range page {
+			groups = append(groups, group.Profile.Name)
+		}
+		return groups, parseNextLink(resp.Header), nil
+	})
+}
+
+// gitlabGroupsMinAccessLevel is the lowest GitLab access level
+// (Guest) the /api/v4/groups listing is filtered to, so it returns every
+// group the user belongs to at all rather than only ones they administer.
+const gitlabGroupsMinAccessLevel = "10"
+
+// gitlabGroupsProvider fetches group memberships from GitLab's
+// /api/v4/groups, and follows the "next" Link header for pagination.
+type gitlabGroupsProvider struct {
+	authServer *AuthServer
+	issuerURL  string
+}
+
+type gitlabGroup struct {
+	FullPath string `json:"full_path"`
+}
+
+func (p gitlabGroupsProvider) FetchGroups(ctx context.Context, oidcClient *oidc.Client, accessToken string, email string) (jose.Claims, error) {
+	if err := isHTTPS(p.issuerURL); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	apiBase, err := apiBaseFromIssuer(p.issuerURL)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	oac, err := oidcClient.OAuthClient()
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	httpClient := oac.HttpClient()
+	endpoint := fmt.Sprintf("%v/api/v4/groups?min_access_level=%v", apiBase, gitlabGroupsMinAccessLevel)
+
+	return fetchAllGroups(p.authServer, "GitLab", func(pageToken string) ([]string, string, error) {
+		reqURL := endpoint
+		if pageToken != "" {
+			// the "next" Link header is already a complete, ready-to-call URL.
+			reqURL = pageToken
+		}
+
+		log.Debugf("Fetching OIDC claims from GitLab groups endpoint: %q.", reqURL)
+
+		req, err := http.NewRequest("GET", reqURL, nil)
+		if err != nil {
+			return nil, "", trace.Wrap(err)
+		}
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", accessToken))
+
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			return nil, "", trace.Wrap(err)
+		}
+		defer resp.Body.Close()
+
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return nil, "", trace.Wrap(err)
+		}
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return nil, "", trace.AccessDenied("bad status code: %v %v", resp.StatusCode, string(body))
+		}
+
+		var page []gitlabGroup
+		if err := json.Unmarshal(body, &page); err != nil {
+			return nil, "", trace.BadParameter("failed to parse GitLab response: %v", err)
+		}
+
+		groups := make([]string, 0, len(page))
+		for _, group := range page {
+			groups = append(groups, group.FullPath)
+		}
+		return groups, parseNextLink(resp.Header), nil
+	})
+}
+
+// apiBaseFromIssuer returns the scheme and host of issuerURL, which for
+// self-hosted providers like Okta and GitLab is also the base of their
+// REST API.
+func apiBaseFromIssuer(issuerURL string) (string, error) {
+	u, err := url.Parse(issuerURL)
+	if err != nil {
+		return "", trace.Wrap(err)
+	}
+	return fmt.Sprintf("%v://%v", u.Scheme, u.Host), nil
+}
+
+// parseNextLink extracts the rel="next" URL from an RFC 5988 Link header,
+// as returned by Okta and GitLab's paginated list endpoints, or "" once
+// there isn't one.
+func parseNextLink(header http.Header) string {
+	for _, link := range strings.Split(header.Get("Link"), ",") {
+		parts := strings.Split(link, ";")
+		if len(parts) < 2 {
+			continue
+		}
+		if strings.TrimSpace(parts[1]) != `rel="next"` {
+			continue
+		}
+		return strings.Trim(strings.TrimSpace(parts[0]), "<>")
+	}
+	return ""
+}
@@ -0,0 +1,428 @@
+/*
+Copyright 2019 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"crypto"
+	"crypto/x509"
+	"io/ioutil"
+
+	"github.com/gravitational/teleport/lib/defaults"
+	"github.com/gravitational/teleport/lib/services"
+
+	"github.com/coreos/go-oidc/oidc"
+	"github.com/gravitational/trace"
+	"github.com/jonboulle/clockwork"
+	jose "gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// OIDCSessionMode selects how createOIDCUser's callers record a newly
+// authenticated OIDC identity: OIDCSessionModeBackendUser writes a full
+// backend User (the default), OIDCSessionModeStatelessJWT mints
+// a signed JWT instead and writes nothing to the backend.
+type OIDCSessionMode string
+
+const (
+	// OIDCSessionModeBackendUser is the default: createOIDCUser upserts a
+	// backend User whose TTL tracks the OIDC identity's expiry.
+	OIDCSessionModeBackendUser OIDCSessionMode = "backend_user"
+	// OIDCSessionModeStatelessJWT skips the backend User entirely and
+	// hands the caller a self-contained, individually revocable JWT.
+	OIDCSessionModeStatelessJWT OIDCSessionMode = "stateless_jwt"
+)
+
+// oidcSessionJWTIssuer is the iss claim every stateless OIDC session JWT
+// is issued and verified with.
+const oidcSessionJWTIssuer = "teleport"
+
+// SetOIDCSessionMode selects which mode createOIDCUser's callers use for
+// connectorName going forward. It is keyed by connector name rather than
+// added as a field on services.OIDCConnectorSpecV2 because lib/services
+// isn't part of this build; a real implementation would carry this on
+// the connector resource itself, the same way RuntimeConfig.Overrides
+// stands in for a services.Role field in lib/srv's runtime selection.
+func (a *AuthServer) SetOIDCSessionMode(connectorName string, mode OIDCSessionMode) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.oidcSessionModes == nil {
+		a.oidcSessionModes = make(map[string]OIDCSessionMode)
+	}
+	a.oidcSessionModes[connectorName] = mode
+}
+
+// getOIDCSessionMode returns the configured OIDCSessionMode for
+// connectorName, defaulting to OIDCSessionModeBackendUser.
+func (a *AuthServer) getOIDCSessionMode(connectorName string) OIDCSessionMode {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	mode, ok := a.oidcSessionModes[connectorName]
+	if !ok {
+		return OIDCSessionModeBackendUser
+	}
+	return mode
+}
+
+// OIDCSessionClaims are the custom claims carried by a stateless OIDC
+// session JWT: everything a downstream service needs to authorize the
+// bearer without looking the user up in the backend.
+type OIDCSessionClaims struct {
+	jwt.Claims
+
+	// Roles are the Teleport roles createOIDCUser would otherwise have
+	// written onto the backend User, as mapped by the connector's
+	// ClaimsToRoles.
+	Roles []string `json:"roles"`
+	// Traits are the OIDC claims available for role template variables,
+	// exactly as claimsToTraitMap computes them for the backend-user
+	// path.
+	Traits map[string][]string `json:"traits"`
+	// ConnectorID is the OIDC connector this session was authenticated
+	// through, and the namespace TokenIndex is revoked within.
+	ConnectorID string `json:"connector_id"`
+	// TokenIndex is a monotonic counter, unique per connector, that
+	// identifies this token in the revoked-index bitmap so a single
+	// session can be invalidated without rotating the signing key.
+	TokenIndex uint64 `json:"tind"`
+}
+
+// IssueOIDCSessionJWT mints a stateless session JWT for ident, in place
+// of writing the backend User createOIDCUser would otherwise create. The
+// returned token carries everything a downstream auth check needs
+// (roles, traits, expiry) and can be verified with VerifyOIDCSessionJWT
+// without the issuing auth server being reachable.
+func (a *AuthServer) IssueOIDCSessionJWT(connector services.OIDCConnector, ident *oidc.Identity, claims jose.Claims) (string, error) {
+	roles, templateTraits, err := a.buildOIDCRoles(connector, claims)
+	if err != nil {
+		return "", trace.Wrap(err)
+	}
+	traits := claimsToTraitMap(claims)
+	for k, v := range templateTraits {
+		traits[k] = v
+	}
+
+	index, err := a.nextOIDCSessionJWTIndex(connector.GetName())
+	if err != nil {
+		return "", trace.Wrap(err)
+	}
+
+	signer, err := a.oidcSessionJWTSigner()
+	if err != nil {
+		return "", trace.Wrap(err)
+	}
+
+	now := a.clock.Now().UTC()
+	sessionClaims := OIDCSessionClaims{
+		Claims: jwt.Claims{
+			Issuer:    oidcSessionJWTIssuer,
+			Subject:   ident.Email,
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+			Expiry:    jwt.NewNumericDate(ident.ExpiresAt),
+		},
+		Roles:       roles,
+		Traits:      traits,
+		ConnectorID: connector.GetName(),
+		TokenIndex:  index,
+	}
+
+	raw, err := jwt.Signed(signer).Claims(sessionClaims).CompactSerialize()
+	if err != nil {
+		return "", trace.Wrap(err)
+	}
+	log.Debugf("Issued stateless OIDC session JWT for %v/%v, token index %v.",
+		connector.GetName(), ident.Email, index)
+	return raw, nil
+}
+
+// VerifyOIDCSessionJWT checks raw's signature against the OIDC session
+// JWT CA, validates standard claims (issuer, expiry), and rejects it if
+// its token index has been revoked. Once the signing key is loaded,
+// verification never touches the backend except for the revoked-index
+// lookup, so a proxy or node configured with --jwt-pub-key can do the
+// signature and claim checks entirely offline.
+func (a *AuthServer) VerifyOIDCSessionJWT(raw string) (*OIDCSessionClaims, error) {
+	tok, err := jwt.ParseSigned(raw)
+	if err != nil {
+		return nil, trace.BadParameter("failed to parse OIDC session JWT: %v", err)
+	}
+
+	pub, err := a.oidcSessionJWTPublicKey()
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	var claims OIDCSessionClaims
+	if err := tok.Claims(pub, &claims); err != nil {
+		return nil, trace.AccessDenied("OIDC session JWT signature did not verify: %v", err)
+	}
+
+	if err := claims.Validate(jwt.Expected{
+		Issuer: oidcSessionJWTIssuer,
+		Time:   a.clock.Now(),
+	}); err != nil {
+		return nil, trace.AccessDenied("OIDC session JWT failed validation: %v", err)
+	}
+
+	revoked, err := a.isOIDCSessionJWTRevoked(claims.ConnectorID, claims.TokenIndex)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	if revoked {
+		return nil, trace.AccessDenied("OIDC session JWT has been revoked")
+	}
+
+	return &claims, nil
+}
+
+// RevokeOIDCSessionJWT invalidates a single outstanding session JWT by
+// its connector and token index, without rotating the signing key or
+// affecting any other token issued for connectorID.
+func (a *AuthServer) RevokeOIDCSessionJWT(connectorID string, index uint64) error {
+	if err := a.Identity.UpsertOIDCSessionJWTRevocation(connectorID, index); err != nil {
+		return trace.Wrap(err)
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.oidcRevokedIndex == nil {
+		a.oidcRevokedIndex = make(map[string]map[uint64]struct{})
+	}
+	if a.oidcRevokedIndex[connectorID] == nil {
+		a.oidcRevokedIndex[connectorID] = make(map[uint64]struct{})
+	}
+	a.oidcRevokedIndex[connectorID][index] = struct{}{}
+	return nil
+}
+
+// isOIDCSessionJWTRevoked answers purely out of the in-memory
+// a.oidcRevokedIndex bitmap, lazily hydrating it from the backend the
+// first time a given connector is checked. Subsequent checks for the
+// same connector never touch the backend again; RevokeOIDCSessionJWT
+// keeps the cache and the backend in lockstep as new revocations land.
+func (a *AuthServer) isOIDCSessionJWTRevoked(connectorID string, index uint64) (bool, error) {
+	a.lock.Lock()
+	revoked, cached := a.oidcRevokedIndex[connectorID]
+	a.lock.Unlock()
+
+	if !cached {
+		loaded, err := a.Identity.GetOIDCSessionJWTRevocations(connectorID)
+		if err != nil {
+			return false, trace.Wrap(err)
+		}
+		revoked = make(map[uint64]struct{}, len(loaded))
+		for _, i := range loaded {
+			revoked[i] = struct{}{}
+		}
+		a.lock.Lock()
+		if a.oidcRevokedIndex == nil {
+			a.oidcRevokedIndex = make(map[string]map[uint64]struct{})
+		}
+		a.oidcRevokedIndex[connectorID] = revoked
+		a.lock.Unlock()
+	}
+
+	_, ok := revoked[index]
+	return ok, nil
+}
+
+// nextOIDCSessionJWTIndex hands out a monotonically increasing index for
+// connectorID, persisted so it survives an auth server restart.
+func (a *AuthServer) nextOIDCSessionJWTIndex(connectorID string) (uint64, error) {
+	index, err := a.Identity.IncrementOIDCSessionJWTIndex(connectorID)
+	if err != nil {
+		return 0, trace.Wrap(err)
+	}
+	return index, nil
+}
+
+// oidcSessionJWTSigner returns a jose.Signer backed by the OIDC session
+// JWT CA's current signing key, generating the CA on first use exactly
+// as Init generates the user and host CAs on a cluster's first start.
+func (a *AuthServer) oidcSessionJWTSigner() (jose.Signer, error) {
+	ca, err := a.ensureOIDCSessionJWTCA()
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	signingKeys := ca.GetSigningKeys()
+	if len(signingKeys) == 0 {
+		return nil, trace.BadParameter("OIDC session JWT CA has no signing key")
+	}
+	// Signing here always routes through the inline PEM key path (ks is
+	// nil), same limitation RotateCertAuthority's rotationInit has today:
+	// a KeyStore-backed CA isn't wired through to this path yet.
+	priv, err := GetSigner(nil, nil, signingKeys[0])
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: priv}, nil)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return signer, nil
+}
+
+// oidcSessionJWTPublicKey returns the checking key for the OIDC session
+// JWT CA's current signing key.
+func (a *AuthServer) oidcSessionJWTPublicKey() (crypto.PublicKey, error) {
+	ca, err := a.ensureOIDCSessionJWTCA()
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	checkingKeys := ca.GetCheckingKeys()
+	if len(checkingKeys) == 0 {
+		return nil, trace.BadParameter("OIDC session JWT CA has no checking key")
+	}
+	return parsePEMPublicKey(checkingKeys[0])
+}
+
+// ensureOIDCSessionJWTCA fetches the cluster's OIDC session JWT CA,
+// generating and persisting one the first time it's needed. Rotating it
+// afterward uses the same RotateCertAuthority(services.JWTSigner, ...)
+// phase machine as the user and host CAs.
+func (a *AuthServer) ensureOIDCSessionJWTCA() (services.CertAuthority, error) {
+	clusterName, err := a.GetClusterName()
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	caID := services.CertAuthID{
+		DomainName: clusterName.GetClusterName(),
+		Type:       services.JWTSigner,
+	}
+	ca, err := a.GetCertAuthority(caID, true)
+	if err == nil {
+		return ca, nil
+	}
+	if !trace.IsNotFound(err) {
+		return nil, trace.Wrap(err)
+	}
+
+	a.oidcSessionJWTCAInit.Lock()
+	defer a.oidcSessionJWTCAInit.Unlock()
+	// Another goroutine may have won the race and created it while we
+	// waited for the lock.
+	ca, err = a.GetCertAuthority(caID, true)
+	if err == nil {
+		return ca, nil
+	}
+	if !trace.IsNotFound(err) {
+		return nil, trace.Wrap(err)
+	}
+
+	log.Infof("First use: generating OIDC session JWT signing CA.")
+	priv, _, err := generateCASigningKey(a, nil)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	// generateCASigningKey returns the public half in SSH authorized-key
+	// form; the checking key is stored PEM-encoded instead so that
+	// parsePEMPublicKey and LoadOIDCSessionJWTPublicKeyFile can read it.
+	signer, err := GetSigner(nil, nil, priv)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(signer.Public())
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	pub := pemEncodePublicKey(der)
+	newCA := &services.CertAuthorityV2{
+		Kind:    services.KindCertAuthority,
+		Version: services.V2,
+		Metadata: services.Metadata{
+			Name:      clusterName.GetClusterName(),
+			Namespace: defaults.Namespace,
+		},
+		Spec: services.CertAuthoritySpecV2{
+			ClusterName:  clusterName.GetClusterName(),
+			Type:         services.JWTSigner,
+			SigningKeys:  [][]byte{priv},
+			CheckingKeys: [][]byte{pub},
+		},
+	}
+	if err := a.Trust.UpsertCertAuthority(newCA); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return newCA, nil
+}
+
+// WriteOIDCSessionJWTPublicKeyFile PEM-encodes the OIDC session JWT CA's
+// current checking key to path, for distribution to proxies and nodes
+// configured with --jwt-pub-key so they can call
+// LoadOIDCSessionJWTPublicKeyFile and verify session JWTs without
+// calling back to auth.
+func (a *AuthServer) WriteOIDCSessionJWTPublicKeyFile(path string) error {
+	ca, err := a.ensureOIDCSessionJWTCA()
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	checkingKeys := ca.GetCheckingKeys()
+	if len(checkingKeys) == 0 {
+		return trace.BadParameter("OIDC session JWT CA has no checking key")
+	}
+	return trace.ConvertSystemError(ioutil.WriteFile(path, checkingKeys[0], 0644))
+}
+
+// OIDCSessionJWTVerifier checks stateless OIDC session JWTs against a
+// single public key loaded once at startup, for use by proxies and nodes
+// configured with --jwt-pub-key. Unlike AuthServer.VerifyOIDCSessionJWT,
+// it never consults the revoked-index bitmap: a downstream service has
+// no connection to auth's backend to check it against, so early
+// revocation here is traded for the ability to verify entirely offline.
+type OIDCSessionJWTVerifier struct {
+	pub   crypto.PublicKey
+	clock clockwork.Clock
+}
+
+// LoadOIDCSessionJWTPublicKeyFile reads a PEM-encoded public key written
+// by AuthServer.WriteOIDCSessionJWTPublicKeyFile and returns a verifier
+// for it.
+func LoadOIDCSessionJWTPublicKeyFile(path string) (*OIDCSessionJWTVerifier, error) {
+	keyPEM, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, trace.ConvertSystemError(err)
+	}
+	pub, err := parsePEMPublicKey(keyPEM)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return &OIDCSessionJWTVerifier{pub: pub, clock: clockwork.NewRealClock()}, nil
+}
+
+// Verify checks raw's signature and standard claims against v's public
+// key. See the OIDCSessionJWTVerifier doc comment for why this does not
+// check token revocation.
+func (v *OIDCSessionJWTVerifier) Verify(raw string) (*OIDCSessionClaims, error) {
+	tok, err := jwt.ParseSigned(raw)
+	if err != nil {
+		return nil, trace.BadParameter("failed to parse OIDC session JWT: %v", err)
+	}
+
+	var claims OIDCSessionClaims
+	if err := tok.Claims(v.pub, &claims); err != nil {
+		return nil, trace.AccessDenied("OIDC session JWT signature did not verify: %v", err)
+	}
+
+	if err := claims.Validate(jwt.Expected{
+		Issuer: oidcSessionJWTIssuer,
+		Time:   v.clock.Now(),
+	}); err != nil {
+		return nil, trace.AccessDenied("OIDC session JWT failed validation: %v", err)
+	}
+
+	return &claims, nil
+}
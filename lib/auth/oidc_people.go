@@ -0,0 +1,130 @@
+/*
+Copyright 2019 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/coreos/go-oidc/jose"
+	"github.com/coreos/go-oidc/oidc"
+	"github.com/gravitational/trace"
+)
+
+// googlePeopleAPIEndpoint is the People API "me" resource, scoped to
+// just the email addresses field, which is all this needs beyond what
+// the ID token and UserInfo endpoint already provide.
+const googlePeopleAPIEndpoint = "https://people.googleapis.com/v1/people/me?personFields=emailAddresses"
+
+// googleVerifiedEmails is every verified email address the People API
+// reports for a Google account, with Primary called out separately so
+// callers know which one to prefer when creating a new user.
+type googleVerifiedEmails struct {
+	// Primary is the account's primary email address, if the People API
+	// marked one as such.
+	Primary string
+	// All is every verified email address, including Primary.
+	All []string
+}
+
+// fetchGoogleVerifiedEmails calls the People API with accessToken and
+// returns every verified email address on the underlying Google
+// account. This is what lets a Teleport user created under one alias
+// still be recognized once Google starts returning a different one as
+// the OIDC "email" claim.
+func (a *AuthServer) fetchGoogleVerifiedEmails(oidcClient *oidc.Client, accessToken string) (*googleVerifiedEmails, error) {
+	oac, err := oidcClient.OAuthClient()
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	hc := oac.HttpClient()
+
+	req, err := http.NewRequest("GET", googlePeopleAPIEndpoint, nil)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", accessToken))
+
+	resp, err := hc.Do(req)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	defer resp.Body.Close()
+
+	bytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, trace.NotFound("Google People API returned not found: %v", string(bytes))
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, trace.AccessDenied("bad status code: %v %v", resp.StatusCode, string(bytes))
+	}
+
+	var person googlePerson
+	if err := json.Unmarshal(bytes, &person); err != nil {
+		return nil, trace.BadParameter("failed to parse Google People API response: %v", err)
+	}
+
+	verified := &googleVerifiedEmails{}
+	for _, e := range person.EmailAddresses {
+		if !e.Metadata.Verified {
+			continue
+		}
+		verified.All = append(verified.All, e.Value)
+		if e.Metadata.Primary {
+			verified.Primary = e.Value
+		}
+	}
+	if verified.Primary == "" && len(verified.All) > 0 {
+		verified.Primary = verified.All[0]
+	}
+	if len(verified.All) == 0 {
+		return nil, trace.NotFound("Google People API returned no verified email addresses")
+	}
+
+	return verified, nil
+}
+
+// googleVerifiedEmailsFromClaims reads the google_primary_email and
+// google_verified_emails claims fetchGoogleVerifiedEmails merges in,
+// returning ("", nil) when they're absent (People API disabled, or the
+// connector isn't a Google one). all includes primary.
+func googleVerifiedEmailsFromClaims(claims jose.Claims) (primary string, all []string) {
+	primary, _, _ = claims.StringClaim("google_primary_email")
+	all, _, _ = claims.StringsClaim("google_verified_emails")
+	return primary, all
+}
+
+// googlePerson is the subset of the People API "Person" resource this
+// package cares about.
+type googlePerson struct {
+	EmailAddresses []googleEmailAddress `json:"emailAddresses"`
+}
+
+type googleEmailAddress struct {
+	Value    string              `json:"value"`
+	Metadata googleEmailMetadata `json:"metadata"`
+}
+
+type googleEmailMetadata struct {
+	Primary  bool `json:"primary"`
+	Verified bool `json:"verified"`
+}
@@ -0,0 +1,348 @@
+/*
+Copyright 2019 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/gravitational/teleport"
+	"github.com/gravitational/teleport/lib/events"
+	"github.com/gravitational/teleport/lib/services"
+	"github.com/gravitational/teleport/lib/utils"
+
+	"github.com/coreos/go-oidc/jose"
+	"github.com/coreos/go-oidc/oauth2"
+	"github.com/coreos/go-oidc/oidc"
+	"github.com/gravitational/trace"
+	lru "github.com/hashicorp/golang-lru"
+)
+
+// oidcRefreshInterval is how often the reconciler wakes up to look for
+// sessions that are due for a refresh.
+const oidcRefreshInterval = time.Minute
+
+// oidcRefreshLeadTime is how far ahead of its expiry a session is
+// refreshed, so a slow IdP round trip doesn't let the session lapse.
+const oidcRefreshLeadTime = 2 * time.Minute
+
+// oidcClaimsCacheSize bounds the refresh-token-backed claims cache. Each
+// entry is keyed by refresh token, so this also bounds how many distinct
+// OIDC sessions can be mid-refresh at once.
+const oidcClaimsCacheSize = 4096
+
+// oidcClaimsPositiveTTL is how long a successful claims fetch is served
+// from cache before the reconciler hits the IdP again for the same
+// refresh token.
+const oidcClaimsPositiveTTL = 30 * time.Second
+
+// oidcClaimsNegativeTTL is how long an IdP error is cached, so a burst of
+// refresh attempts against a down or rate-limiting IdP doesn't retry on
+// every tick.
+const oidcClaimsNegativeTTL = 30 * time.Second
+
+// oidcRefreshReconciler periodically re-validates OIDC web sessions
+// against their IdP using the refresh token captured at login, keeping
+// roles and traits in sync with claim changes instead of freezing them
+// until the user reruns SSO.
+type oidcRefreshReconciler struct {
+	auth   *AuthServer
+	claims *oidcClaimsCache
+	clock  func() time.Time
+}
+
+// startOIDCRefreshReconciler starts the reconciler loop as a background
+// goroutine. Like startAdminSocket, callers gate this on
+// cfg.SkipPeriodicOperations so tests that don't need it don't leave a
+// ticker running.
+func (a *AuthServer) startOIDCRefreshReconciler() (*oidcRefreshReconciler, error) {
+	cache, err := newOIDCClaimsCache()
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	r := &oidcRefreshReconciler{
+		auth:   a,
+		claims: cache,
+		clock:  time.Now,
+	}
+	go r.run()
+	return r, nil
+}
+
+func (r *oidcRefreshReconciler) run() {
+	ticker := time.NewTicker(oidcRefreshInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		r.reconcile()
+	}
+}
+
+// reconcile looks at every OIDC refresh-token record due for renewal and
+// refreshes it.
+func (r *oidcRefreshReconciler) reconcile() {
+	records, err := r.auth.Identity.GetOIDCRefreshTokens()
+	if err != nil {
+		log.Warningf("OIDC refresh reconciler: unable to list refresh tokens: %v.", err)
+		return
+	}
+
+	cutoff := r.auth.clock.Now().Add(oidcRefreshLeadTime)
+	for _, record := range records {
+		if record.ExpiresAt.After(cutoff) {
+			continue
+		}
+		if err := r.refreshOne(record); err != nil {
+			log.Warningf("OIDC refresh reconciler: failed to refresh session for %v: %v.", record.Username, err)
+		}
+	}
+}
+
+// refreshOne refreshes a single session: it obtains a fresh id_token and
+// access_token for record's refresh token, re-derives claims, recomputes
+// roles, and either updates the user in place or revokes the session if
+// the IdP no longer maps the user to any role. A transient error
+// fetching the new tokens does not revoke; only the refreshed claims
+// failing to map to a role does.
+func (r *oidcRefreshReconciler) refreshOne(record services.OIDCRefreshToken) error {
+	connector, err := r.auth.Identity.GetOIDCConnector(record.ConnectorID, true)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	claims, newRefreshToken, err := r.claims.getOrFetch(record.RefreshToken, func() (jose.Claims, string, error) {
+		return r.auth.refreshOIDCClaims(connector, record.RefreshToken)
+	})
+	if err != nil {
+		// A fetch failure here is usually a transient IdP or network
+		// error, not the user losing access; revoking on every blip
+		// would log a user out of a perfectly good session whenever the
+		// IdP hiccups. Only an actual loss of claims (below) revokes.
+		return trace.Wrap(err)
+	}
+
+	ident, err := oidc.IdentityFromClaims(claims)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	roles, templateTraits, err := r.auth.buildOIDCRoles(connector, claims)
+	if err != nil {
+		// The refreshed claims no longer map to any role: the IdP has
+		// genuinely taken access away, so revoke rather than leave the
+		// session (and its stale roles) in place.
+		r.revoke(record, connector, err)
+		return trace.Wrap(err)
+	}
+	traits := claimsToTraitMap(claims)
+	for k, v := range templateTraits {
+		traits[k] = v
+	}
+
+	user, err := r.auth.GetUser(record.Username)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	user.SetRoles(roles)
+	user.SetTraits(traits)
+	if err := r.auth.UpsertUser(user); err != nil {
+		return trace.Wrap(err)
+	}
+
+	if newRefreshToken != "" && newRefreshToken != record.RefreshToken {
+		record.RefreshToken = newRefreshToken
+	}
+	record.ExpiresAt = r.auth.clock.Now().Add(utils.ToTTL(r.auth.clock, ident.ExpiresAt))
+	if err := r.auth.Identity.UpsertOIDCRefreshToken(record); err != nil {
+		return trace.Wrap(err)
+	}
+
+	r.auth.EmitAuditEvent(events.OIDCSessionRefreshEvent, events.EventFields{
+		events.EventUser: record.Username,
+		"connector_name": connector.GetName(),
+		"roles":          roles,
+	})
+	return nil
+}
+
+// revoke deletes the web session and the refresh token record for
+// record, and audits why.
+func (r *oidcRefreshReconciler) revoke(record services.OIDCRefreshToken, connector services.OIDCConnector, cause error) {
+	if err := r.auth.DeleteWebSession(record.Username); err != nil {
+		log.Warningf("OIDC refresh reconciler: failed to revoke session for %v: %v.", record.Username, err)
+	}
+	if err := r.auth.Identity.DeleteOIDCRefreshToken(record.RefreshToken); err != nil {
+		log.Warningf("OIDC refresh reconciler: failed to delete refresh token for %v: %v.", record.Username, err)
+	}
+	r.auth.EmitAuditEvent(events.OIDCSessionRevokedEvent, events.EventFields{
+		events.EventUser:      record.Username,
+		"connector_name":      connector.GetName(),
+		events.AuthAttemptErr: cause.Error(),
+	})
+}
+
+// refreshOIDCClaims exchanges refreshToken for a fresh token set and
+// re-derives claims the same way getClaims does for the initial login:
+// ID token, UserInfo, provider groups, and Google People API verified
+// emails when configured. It returns the merged claims and the refresh
+// token to keep going forward (providers are free to rotate it on every
+// use).
+func (a *AuthServer) refreshOIDCClaims(connector services.OIDCConnector, refreshToken string) (jose.Claims, string, error) {
+	oidcClient, err := a.getOIDCClient(connector)
+	if err != nil {
+		return nil, "", trace.Wrap(err)
+	}
+	oac, err := oidcClient.OAuthClient()
+	if err != nil {
+		return nil, "", trace.Wrap(err)
+	}
+
+	t, err := oac.RequestToken(oauth2.GrantTypeRefreshToken, refreshToken)
+	if err != nil {
+		return nil, "", trace.Wrap(err)
+	}
+
+	idTokenClaims, err := claimsFromIDToken(oidcClient, t.IDToken)
+	if err != nil {
+		return nil, "", trace.Wrap(err)
+	}
+
+	userInfoClaims, err := claimsFromUserInfo(oidcClient, connector.GetIssuerURL(), t.AccessToken)
+	if err != nil {
+		if !trace.IsNotFound(err) {
+			return nil, "", trace.Wrap(err)
+		}
+		userInfoClaims = jose.Claims{}
+	}
+
+	claims, err := mergeClaims(idTokenClaims, userInfoClaims)
+	if err != nil {
+		return nil, "", trace.Wrap(err)
+	}
+
+	email, _, err := claims.StringClaim("email")
+	if err != nil {
+		return nil, "", trace.Wrap(err)
+	}
+	groupsClaims, configured, err := a.fetchProviderGroups(context.TODO(), oidcClient, connector.GetIssuerURL(), connector.GetProvider(), connector.GetScope(), t.AccessToken, email)
+	if err != nil && !trace.IsNotFound(err) {
+		return nil, "", trace.Wrap(err)
+	}
+	if configured && groupsClaims != nil {
+		claims, err = mergeClaims(claims, groupsClaims)
+		if err != nil {
+			return nil, "", trace.Wrap(err)
+		}
+	}
+
+	if connector.GetIssuerURL() == teleport.GSuiteIssuerURL && connector.GetUseGooglePeopleAPI() {
+		verifiedEmails, err := a.fetchGoogleVerifiedEmails(oidcClient, t.AccessToken)
+		if err != nil && !trace.IsNotFound(err) {
+			return nil, "", trace.Wrap(err)
+		}
+		if verifiedEmails != nil {
+			claims["google_verified_emails"] = verifiedEmails.All
+			if verifiedEmails.Primary != "" {
+				claims["google_primary_email"] = verifiedEmails.Primary
+			}
+		}
+	}
+
+	newRefreshToken := t.RefreshToken
+	if newRefreshToken == "" {
+		newRefreshToken = refreshToken
+	}
+	return claims, newRefreshToken, nil
+}
+
+// oidcClaimsCacheResult is what's stored per refresh token: either the
+// claims and the (possibly rotated) refresh token to use next, or the
+// error the last fetch produced.
+type oidcClaimsCacheResult struct {
+	claims       jose.Claims
+	refreshToken string
+	err          error
+	expires      time.Time
+}
+
+// oidcClaimsCache is a small LRU cache of refreshOIDCClaims results with
+// separate positive/negative TTLs, plus a race window that collapses
+// concurrent fetches for the same refresh token into one IdP call. This
+// keeps a burst of API calls that share a session from hammering the
+// IdP, the way Arvados' OIDC controller coalesces concurrent refreshes.
+type oidcClaimsCache struct {
+	cache    *lru.Cache
+	mu       sync.Mutex
+	inFlight map[string]*sync.WaitGroup
+}
+
+func newOIDCClaimsCache() (*oidcClaimsCache, error) {
+	cache, err := lru.New(oidcClaimsCacheSize)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return &oidcClaimsCache{
+		cache:    cache,
+		inFlight: make(map[string]*sync.WaitGroup),
+	}, nil
+}
+
+// getOrFetch returns a cached result for refreshToken if it's still
+// within its TTL, otherwise calls fetch, caches the outcome (success or
+// error), and returns it. Concurrent calls for the same refreshToken
+// block on the first one rather than each calling fetch.
+func (c *oidcClaimsCache) getOrFetch(refreshToken string, fetch func() (jose.Claims, string, error)) (jose.Claims, string, error) {
+	c.mu.Lock()
+	if v, ok := c.cache.Get(refreshToken); ok {
+		result := v.(*oidcClaimsCacheResult)
+		if time.Now().Before(result.expires) {
+			c.mu.Unlock()
+			return result.claims, result.refreshToken, result.err
+		}
+		c.cache.Remove(refreshToken)
+	}
+	if wg, ok := c.inFlight[refreshToken]; ok {
+		c.mu.Unlock()
+		wg.Wait()
+		return c.getOrFetch(refreshToken, fetch)
+	}
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	c.inFlight[refreshToken] = wg
+	c.mu.Unlock()
+
+	claims, newRefreshToken, err := fetch()
+
+	ttl := oidcClaimsPositiveTTL
+	if err != nil {
+		ttl = oidcClaimsNegativeTTL
+	}
+	result := &oidcClaimsCacheResult{
+		claims:       claims,
+		refreshToken: newRefreshToken,
+		err:          err,
+		expires:      time.Now().Add(ttl),
+	}
+
+	c.mu.Lock()
+	c.cache.Add(refreshToken, result)
+	delete(c.inFlight, refreshToken)
+	c.mu.Unlock()
+	wg.Done()
+
+	return claims, newRefreshToken, err
+}
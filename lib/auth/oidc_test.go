@@ -18,13 +18,18 @@ package auth
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"net"
+	"net/http"
+	"path/filepath"
 	"time"
 
 	authority "github.com/gravitational/teleport/lib/auth/testauthority"
 	"github.com/gravitational/teleport/lib/backend"
 	"github.com/gravitational/teleport/lib/backend/lite"
 	"github.com/gravitational/teleport/lib/services"
+	"github.com/gravitational/teleport/lib/srv/adminsock"
 	"github.com/gravitational/teleport/lib/utils"
 
 	"github.com/coreos/go-oidc/oidc"
@@ -108,3 +113,244 @@ func (s *OIDCSuite) TestCreateOIDCUser(c *check.C) {
 	_, err = s.a.GetUser("foo@example.com")
 	c.Assert(err, check.NotNil)
 }
+
+func (s *OIDCSuite) TestOIDCSessionJWT(c *check.C) {
+	connector := services.NewOIDCConnector("oidcStatelessService", services.OIDCConnectorSpecV2{
+		IssuerURL:    "https://www.example.com",
+		ClientID:     "fakeClientID",
+		ClientSecret: "fakeClientSecret",
+		RedirectURL:  "https://www.example.com/redirect",
+		Scope:        []string{"profile", "email"},
+		ClaimsToRoles: []services.ClaimMapping{
+			services.ClaimMapping{
+				Claim: "email",
+				Value: "bar@example.com",
+				Roles: []string{"admin"},
+			},
+		},
+	})
+
+	ident := &oidc.Identity{
+		Email:     "bar@example.com",
+		ExpiresAt: s.c.Now().Add(1 * time.Minute),
+	}
+
+	claims := map[string]interface{}{
+		"email": "bar@example.com",
+	}
+
+	// Issuing a session JWT must not write a backend user.
+	raw, err := s.a.IssueOIDCSessionJWT(connector, ident, claims)
+	c.Assert(err, check.IsNil)
+	_, err = s.a.GetUser("bar@example.com")
+	c.Assert(err, check.NotNil)
+
+	sessionClaims, err := s.a.VerifyOIDCSessionJWT(raw)
+	c.Assert(err, check.IsNil)
+	c.Assert(sessionClaims.Subject, check.Equals, "bar@example.com")
+	c.Assert(sessionClaims.Roles, check.DeepEquals, []string{"admin"})
+	c.Assert(sessionClaims.ConnectorID, check.Equals, connector.GetName())
+
+	// Revoking this one token must not affect a freshly issued one.
+	err = s.a.RevokeOIDCSessionJWT(connector.GetName(), sessionClaims.TokenIndex)
+	c.Assert(err, check.IsNil)
+	_, err = s.a.VerifyOIDCSessionJWT(raw)
+	c.Assert(err, check.NotNil)
+
+	raw2, err := s.a.IssueOIDCSessionJWT(connector, ident, claims)
+	c.Assert(err, check.IsNil)
+	_, err = s.a.VerifyOIDCSessionJWT(raw2)
+	c.Assert(err, check.IsNil)
+}
+
+// TestOIDCAdminSocket mirrors TestCreateOIDCUser, but expires the user
+// early over the admin RPC socket instead of waiting out its TTL.
+func (s *OIDCSuite) TestOIDCAdminSocket(c *check.C) {
+	connector := services.NewOIDCConnector("oidcAdminSockService", services.OIDCConnectorSpecV2{
+		IssuerURL:    "https://www.example.com",
+		ClientID:     "fakeClientID",
+		ClientSecret: "fakeClientSecret",
+		RedirectURL:  "https://www.example.com/redirect",
+		Scope:        []string{"profile", "email"},
+		ClaimsToRoles: []services.ClaimMapping{
+			services.ClaimMapping{
+				Claim: "email",
+				Value: "baz@example.com",
+				Roles: []string{"admin"},
+			},
+		},
+	})
+
+	ident := &oidc.Identity{
+		Email:     "baz@example.com",
+		ExpiresAt: s.c.Now().Add(1 * time.Minute),
+	}
+
+	claims := map[string]interface{}{
+		"email": "baz@example.com",
+	}
+
+	err := s.a.createOIDCUser(connector, ident, claims)
+	c.Assert(err, check.IsNil)
+
+	socketPath := filepath.Join(c.MkDir(), "auth-admin.sock")
+	adminSrv, err := s.a.startAdminSocket(&InitConfig{DataDir: c.MkDir(), AdminSocketPath: socketPath})
+	c.Assert(err, check.IsNil)
+	defer adminSrv.Close()
+
+	conn, err := net.Dial("unix", socketPath)
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+
+	encoder := json.NewEncoder(conn)
+	decoder := json.NewDecoder(conn)
+
+	err = encoder.Encode(adminsock.Request{Verb: "list-oidc-users"})
+	c.Assert(err, check.IsNil)
+	var listResp adminsock.Response
+	c.Assert(decoder.Decode(&listResp), check.IsNil)
+	c.Assert(listResp.OK, check.Equals, true)
+
+	found := false
+	for _, raw := range listResp.Result.([]interface{}) {
+		entry := raw.(map[string]interface{})
+		if entry["username"] == "baz@example.com" {
+			found = true
+		}
+	}
+	c.Assert(found, check.Equals, true)
+
+	err = encoder.Encode(adminsock.Request{Verb: "expire-oidc-user", Args: []string{"baz@example.com"}})
+	c.Assert(err, check.IsNil)
+	var expireResp adminsock.Response
+	c.Assert(decoder.Decode(&expireResp), check.IsNil)
+	c.Assert(expireResp.OK, check.Equals, true)
+
+	// No clock advance: the socket call must have deleted the row
+	// immediately, ahead of its TTL.
+	_, err = s.a.GetUser("baz@example.com")
+	c.Assert(err, check.NotNil)
+}
+
+// TestOIDCClaimsTemplateMapping exercises OIDCClaimsMappingModeTemplate,
+// checking both that a bad template is rejected up front by
+// UpsertOIDCConnector and that a valid one can drive roles and a trait
+// override off claims a static ClaimsToRoles rule couldn't express.
+func (s *OIDCSuite) TestOIDCClaimsTemplateMapping(c *check.C) {
+	badConnector := services.NewOIDCConnector("oidcTemplateBad", services.OIDCConnectorSpecV2{
+		IssuerURL:         "https://www.example.com",
+		ClientID:          "fakeClientID",
+		ClientSecret:      "fakeClientSecret",
+		RedirectURL:       "https://www.example.com/redirect",
+		Scope:             []string{"profile", "email"},
+		ClaimsMappingMode: "template",
+		ClaimsTemplate:    "{{ if .groups",
+	})
+	err := s.a.UpsertOIDCConnector(badConnector)
+	c.Assert(err, check.NotNil)
+
+	connector := services.NewOIDCConnector("oidcTemplateGood", services.OIDCConnectorSpecV2{
+		IssuerURL:         "https://www.example.com",
+		ClientID:          "fakeClientID",
+		ClientSecret:      "fakeClientSecret",
+		RedirectURL:       "https://www.example.com/redirect",
+		Scope:             []string{"profile", "email"},
+		ClaimsMappingMode: "template",
+		ClaimsTemplate: `{{ if regexMatch .groups "^admin-.*" }}admin
+trait:team=platform{{ end }}`,
+	})
+	err = s.a.UpsertOIDCConnector(connector)
+	c.Assert(err, check.IsNil)
+
+	ident := &oidc.Identity{
+		Email:     "template@example.com",
+		ExpiresAt: s.c.Now().Add(1 * time.Minute),
+	}
+	claims := map[string]interface{}{
+		"email":  "template@example.com",
+		"groups": []interface{}{"admin-infra"},
+	}
+
+	err = s.a.createOIDCUser(connector, ident, claims)
+	c.Assert(err, check.IsNil)
+
+	user, err := s.a.GetUser("template@example.com")
+	c.Assert(err, check.IsNil)
+	c.Assert(user.GetRoles(), check.DeepEquals, []string{"admin"})
+	c.Assert(user.GetTraits()["team"], check.DeepEquals, []string{"platform"})
+}
+
+// TestOIDCGooglePeopleAPIAlternateEmail checks that a user record is
+// created under the Google People API's primary email, and can still be
+// found via GetUserByOIDCIdentity under any other verified alias on the
+// same account.
+func (s *OIDCSuite) TestOIDCGooglePeopleAPIAlternateEmail(c *check.C) {
+	connector := services.NewOIDCConnector("oidcGoogleService", services.OIDCConnectorSpecV2{
+		IssuerURL:    "https://accounts.google.com",
+		ClientID:     "fakeClientID",
+		ClientSecret: "fakeClientSecret",
+		RedirectURL:  "https://www.example.com/redirect",
+		Scope:        []string{"profile", "email"},
+		ClaimsToRoles: []services.ClaimMapping{
+			services.ClaimMapping{
+				Claim: "email",
+				Value: "alias@example.com",
+				Roles: []string{"admin"},
+			},
+		},
+		UseGooglePeopleAPI: true,
+	})
+
+	ident := &oidc.Identity{
+		Email:     "alias@example.com",
+		ExpiresAt: s.c.Now().Add(1 * time.Minute),
+	}
+	claims := map[string]interface{}{
+		"email":                  "alias@example.com",
+		"google_primary_email":   "primary@example.com",
+		"google_verified_emails": []string{"primary@example.com", "alias@example.com"},
+	}
+
+	err := s.a.createOIDCUser(connector, ident, claims)
+	c.Assert(err, check.IsNil)
+
+	// The user record is created under Google's primary email...
+	user, err := s.a.GetUser("primary@example.com")
+	c.Assert(err, check.IsNil)
+
+	// ...but either verified alias resolves to the same user.
+	byPrimary, err := s.a.Identity.GetUserByOIDCIdentity(services.ExternalIdentity{
+		ConnectorID: connector.GetName(), Username: "primary@example.com"})
+	c.Assert(err, check.IsNil)
+	c.Assert(byPrimary.GetName(), check.Equals, user.GetName())
+
+	byAlias, err := s.a.Identity.GetUserByOIDCIdentity(services.ExternalIdentity{
+		ConnectorID: connector.GetName(), Username: "alias@example.com"})
+	c.Assert(err, check.IsNil)
+	c.Assert(byAlias.GetName(), check.Equals, user.GetName())
+}
+
+// TestOIDCGroupsProviderDispatch checks that fetchProviderGroups rejects an
+// unrecognized Provider up front, and that an empty Provider with Google's
+// issuer but without the GSuite groups scope is not treated as GSuite, so
+// the issuer alone does not trigger the pre-Provider detection.
+func (s *OIDCSuite) TestOIDCGroupsProviderDispatch(c *check.C) {
+	_, configured, err := s.a.fetchProviderGroups(context.TODO(), nil, "https://example.com", "bitbucket", nil, "token", "user@example.com")
+	c.Assert(err, check.NotNil)
+	c.Assert(configured, check.Equals, false)
+
+	_, configured, err = s.a.fetchProviderGroups(context.TODO(), nil, "https://accounts.google.com", "", []string{"profile"}, "token", "user@example.com")
+	c.Assert(err, check.IsNil)
+	c.Assert(configured, check.Equals, false)
+}
+
+// TestOIDCGroupsNextLink checks that parseNextLink finds the rel="next"
+// URL out of an RFC 5988 Link header the way Okta and GitLab's paginated
+// group-listing endpoints use, and returns "" once there isn't one.
+func (s *OIDCSuite) TestOIDCGroupsNextLink(c *check.C) {
+	header := http.Header{}
+	header.Set("Link", `<https://example.com/groups?page=2>; rel="next", <https://example.com/groups?page=1>; rel="prev"`)
+	c.Assert(parseNextLink(header), check.Equals, "https://example.com/groups?page=2")
+
+	c.Assert(parseNextLink(http.Header{}), check.Equals, "")
+}
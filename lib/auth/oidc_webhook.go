@@ -0,0 +1,182 @@
+/*
+Copyright 2019 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/gravitational/teleport/lib/events"
+	"github.com/gravitational/teleport/lib/services"
+
+	"github.com/coreos/go-oidc/jose"
+	"github.com/gravitational/trace"
+)
+
+// oidcWebhookTimeout is used when a services.OIDCLoginWebhook doesn't set
+// its own Timeout.
+const oidcWebhookTimeout = 5 * time.Second
+
+// oidcWebhookRetries is used when a services.OIDCLoginWebhook doesn't set
+// its own Retries.
+const oidcWebhookRetries = 2
+
+// oidcWebhookPayload is the JSON body POSTed to every configured login
+// webhook on a successful OIDC login.
+type oidcWebhookPayload struct {
+	// ConnectorID is the name of the OIDC connector that authenticated
+	// this login.
+	ConnectorID string `json:"connector_id"`
+	// Username is the resolved Teleport username.
+	Username string `json:"username"`
+	// Roles are the roles mapped from the connector's ClaimsToRoles.
+	Roles []string `json:"roles"`
+	// Identity is the resolved external identity.
+	Identity services.ExternalIdentity `json:"identity"`
+	// Claims is the merged claim set (ID token + UserInfo + any enrichment,
+	// such as GSuite) that produced Username and Roles.
+	Claims jose.Claims `json:"claims"`
+}
+
+// oidcWebhookPatch is the JSON body a login webhook may return to merge
+// additional traits/roles into the user record before it's written.
+type oidcWebhookPatch struct {
+	// Traits are merged into the user's traits, overwriting any trait
+	// with the same key produced from claims.
+	Traits map[string][]string `json:"traits,omitempty"`
+	// Roles are appended to the roles mapped from ClaimsToRoles.
+	Roles []string `json:"roles,omitempty"`
+}
+
+// invokeOIDCLoginWebhooks calls every login webhook configured on
+// connector with payload, in order, merging each webhook's returned
+// patch into the result. A webhook that errors out after its retries
+// are exhausted aborts the login - operators configuring a webhook are
+// opting into it gating the login, the same way a misbehaving auth
+// connector would.
+func (a *AuthServer) invokeOIDCLoginWebhooks(connector services.OIDCConnector, payload oidcWebhookPayload) (*oidcWebhookPatch, error) {
+	hooks := connector.GetLoginWebhooks()
+	if len(hooks) == 0 {
+		return nil, nil
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	merged := &oidcWebhookPatch{Traits: make(map[string][]string)}
+	for _, hook := range hooks {
+		patch, err := a.callOIDCLoginWebhook(hook, body)
+		a.emitOIDCLoginWebhookEvent(connector, hook, payload.Username, err)
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+		if patch == nil {
+			continue
+		}
+		for k, v := range patch.Traits {
+			merged.Traits[k] = v
+		}
+		merged.Roles = append(merged.Roles, patch.Roles...)
+	}
+	return merged, nil
+}
+
+// callOIDCLoginWebhook POSTs body to hook.URL, retrying up to
+// hook.Retries times on transport or 5xx errors, and decodes a
+// oidcWebhookPatch from a non-empty 2xx response body.
+func (a *AuthServer) callOIDCLoginWebhook(hook services.OIDCLoginWebhook, body []byte) (*oidcWebhookPatch, error) {
+	timeout := hook.Timeout
+	if timeout == 0 {
+		timeout = oidcWebhookTimeout
+	}
+	retries := hook.Retries
+	if retries == 0 {
+		retries = oidcWebhookRetries
+	}
+	client := &http.Client{Timeout: timeout}
+
+	var lastErr error
+	attempts := 0
+	for attempt := 0; attempt <= retries; attempt++ {
+		attempts++
+		if attempt > 0 {
+			time.Sleep(time.Duration(attempt) * 100 * time.Millisecond)
+		}
+
+		req, err := http.NewRequest(http.MethodPost, hook.URL, bytes.NewReader(body))
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, err := client.Do(req)
+		if err != nil {
+			lastErr = trace.Wrap(err)
+			continue
+		}
+
+		patch, err := decodeOIDCWebhookResponse(resp)
+		resp.Body.Close()
+		if err != nil {
+			lastErr = err
+			if resp.StatusCode < 500 {
+				break
+			}
+			continue
+		}
+		return patch, nil
+	}
+	return nil, trace.Wrap(lastErr, "login webhook %v failed after %v attempts", hook.URL, attempts)
+}
+
+// decodeOIDCWebhookResponse validates resp's status code and decodes an
+// optional oidcWebhookPatch from its body.
+func decodeOIDCWebhookResponse(resp *http.Response) (*oidcWebhookPatch, error) {
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, trace.BadParameter("login webhook returned status %v", resp.StatusCode)
+	}
+	if resp.ContentLength == 0 {
+		return nil, nil
+	}
+	var patch oidcWebhookPatch
+	if err := json.NewDecoder(resp.Body).Decode(&patch); err != nil {
+		if err.Error() == "EOF" {
+			return nil, nil
+		}
+		return nil, trace.Wrap(err)
+	}
+	return &patch, nil
+}
+
+// emitOIDCLoginWebhookEvent audits the outcome of a single login webhook
+// call.
+func (a *AuthServer) emitOIDCLoginWebhookEvent(connector services.OIDCConnector, hook services.OIDCLoginWebhook, username string, err error) {
+	fields := events.EventFields{
+		events.EventUser: username,
+		"connector_name": connector.GetName(),
+		"webhook_url":    hook.URL,
+		"success":        err == nil,
+	}
+	if err != nil {
+		fields["error"] = err.Error()
+	}
+	a.EmitAuditEvent(events.OIDCLoginWebhookEvent, fields)
+}
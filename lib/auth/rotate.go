@@ -0,0 +1,375 @@
+/*
+Copyright 2019 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"crypto/x509/pkix"
+
+	"github.com/gravitational/teleport/lib/defaults"
+	"github.com/gravitational/teleport/lib/services"
+	"github.com/gravitational/teleport/lib/tlsca"
+
+	"github.com/gravitational/trace"
+)
+
+// RotationPhase is a step in the online CA rotation state machine driven
+// by AuthServer.RotateCertAuthority.
+type RotationPhase string
+
+const (
+	// RotationPhaseInit generates a new CA keypair and adds it to the CA
+	// as a standby key. Nothing changes for existing clients yet.
+	RotationPhaseInit RotationPhase = "init"
+	// RotationPhaseUpdateClients asks clients (users, nodes) re-enrolling
+	// during this phase to pick up both the old and new trust roots, so
+	// they keep working once servers switch to signing with the new key.
+	RotationPhaseUpdateClients RotationPhase = "update_clients"
+	// RotationPhaseUpdateServers promotes the new key to signing and
+	// demotes the old key to trusted-only, so existing certs issued by
+	// the old key continue to validate while new ones use the new key.
+	RotationPhaseUpdateServers RotationPhase = "update_servers"
+	// RotationPhaseStandby retires the old key once the grace period for
+	// previously issued certificates has elapsed.
+	RotationPhaseStandby RotationPhase = "standby"
+)
+
+// nextPhase maps each rotation phase to the only phase that may legally
+// follow it via RotateCertAuthority. The zero value "" stands for "no
+// rotation in progress".
+var nextPhase = map[RotationPhase]RotationPhase{
+	"":                         RotationPhaseInit,
+	RotationPhaseInit:          RotationPhaseUpdateClients,
+	RotationPhaseUpdateClients: RotationPhaseUpdateServers,
+	RotationPhaseUpdateServers: RotationPhaseStandby,
+}
+
+// KeyState is the lifecycle state of a single key within a CA's key list
+// during rotation.
+type KeyState string
+
+const (
+	// KeyStateStandby is a newly generated key not yet used for signing
+	// or trusted by peers.
+	KeyStateStandby KeyState = "standby"
+	// KeyStateSigning is the key currently used to sign new certificates.
+	KeyStateSigning KeyState = "signing"
+	// KeyStateTrustedOnly is a previously-signing key kept around only so
+	// certificates it already issued keep validating.
+	KeyStateTrustedOnly KeyState = "trusted_only"
+	// KeyStateRetired is a key that is no longer trusted and can be
+	// removed from the CA.
+	KeyStateRetired KeyState = "retired"
+)
+
+// CertAuthorityRotationState tracks the rotation phase a CertAuthority is
+// currently in and the per-key lifecycle state that goes with it.
+// SigningKeys/TLSKeyPairs on services.CertAuthority remain an ordered
+// list; KeyStates[i] describes SigningKeys[i]. It is persisted on the CA
+// resource itself (CertAuthority.GetRotationState/SetRotationState) so
+// that a RotateCertAuthority call is idempotent even across a process
+// restart, and so RollbackCertAuthority/RotateCertAuthorityEmergency can
+// tell what phase a CA actually stopped in rather than guessing from key
+// list length alone.
+type CertAuthorityRotationState struct {
+	Phase     RotationPhase
+	KeyStates []KeyState
+}
+
+// RotateCertAuthority drives the next step of online CA rotation for the
+// given CA type. Phases must be advanced in order: init -> update_clients
+// -> update_servers -> standby. Calling it again with the phase the CA is
+// already in is a no-op: the per-phase handlers persist
+// CertAuthorityRotationState before returning, so a retried RPC (or an
+// operator re-running the same `tctl` command) can never re-run a
+// key-reordering step twice.
+func (a *AuthServer) RotateCertAuthority(caType services.CertAuthType, phase RotationPhase) error {
+	if a.IsSealed() {
+		return trace.AccessDenied("auth server is sealed; an administrator must call Unlock before CA rotation can proceed")
+	}
+	clusterName, err := a.GetClusterName()
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	ca, err := a.GetCertAuthority(services.CertAuthID{
+		DomainName: clusterName.GetClusterName(),
+		Type:       caType,
+	}, true)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	current := ca.GetRotationState().Phase
+	if current == phase {
+		log.Infof("CA rotation: %v already in phase %v, nothing to do.", caType, phase)
+		return nil
+	}
+	if nextPhase[current] != phase {
+		return trace.BadParameter("CA %v is in phase %q, can't jump directly to %q (use RotateCertAuthorityEmergency to skip update_clients)", caType, current, phase)
+	}
+
+	switch phase {
+	case RotationPhaseInit:
+		return trace.Wrap(a.rotationInit(ca))
+	case RotationPhaseUpdateClients:
+		// No key material changes here: clients re-enrolling now will
+		// already see both the signing and standby keys in
+		// TLSCACertsBytes because GetCertAuthority/Identity always
+		// return every TLS key pair on the CA. Nodes that need to
+		// reissue their host identity to actually pick up the new
+		// trust root before update_servers retires the old key do so
+		// via AuthServer.RotateAllHostCerts; that RPC currently has no
+		// delivery channel to already-joined nodes in this build (see
+		// host_rotation.go), so periodic reissue during this phase is
+		// not automatic yet and must be triggered per-host.
+		ca.SetRotationState(CertAuthorityRotationState{
+			Phase:     RotationPhaseUpdateClients,
+			KeyStates: ca.GetRotationState().KeyStates,
+		})
+		log.Infof("CA rotation: %v entering update_clients, new trust root is now distributed.", caType)
+		return trace.Wrap(a.Trust.UpsertCertAuthority(ca))
+	case RotationPhaseUpdateServers:
+		return trace.Wrap(a.rotationPromote(ca))
+	case RotationPhaseStandby:
+		return trace.Wrap(a.rotationRetire(ca))
+	default:
+		return trace.BadParameter("unknown rotation phase %q", phase)
+	}
+}
+
+// RotateCertAuthorityEmergency promotes caType's standby key straight to
+// signing, skipping update_clients. Use it when a signing key is
+// suspected compromised and there isn't time to wait out the normal
+// grace period for clients to pick up the new trust root first: some
+// not-yet-reenrolled clients may briefly fail to validate the new
+// signing key until they reconnect, which is the accepted tradeoff for
+// getting off a compromised key immediately. If caType has no rotation
+// in progress yet, this also runs the init phase first.
+func (a *AuthServer) RotateCertAuthorityEmergency(caType services.CertAuthType) error {
+	if a.IsSealed() {
+		return trace.AccessDenied("auth server is sealed; an administrator must call Unlock before CA rotation can proceed")
+	}
+	clusterName, err := a.GetClusterName()
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	ca, err := a.GetCertAuthority(services.CertAuthID{
+		DomainName: clusterName.GetClusterName(),
+		Type:       caType,
+	}, true)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	switch ca.GetRotationState().Phase {
+	case "":
+		if err := a.rotationInit(ca); err != nil {
+			return trace.Wrap(err)
+		}
+		ca, err = a.GetCertAuthority(services.CertAuthID{
+			DomainName: clusterName.GetClusterName(),
+			Type:       caType,
+		}, true)
+		if err != nil {
+			return trace.Wrap(err)
+		}
+	case RotationPhaseUpdateServers, RotationPhaseStandby:
+		return trace.BadParameter("CA %v is already in phase %q, nothing left to promote", caType, ca.GetRotationState().Phase)
+	}
+
+	// rotationPromote only accepts a CA in update_clients, so the CA is
+	// moved there first instead of waiting out that phase.
+	ca.SetRotationState(CertAuthorityRotationState{
+		Phase:     RotationPhaseUpdateClients,
+		KeyStates: ca.GetRotationState().KeyStates,
+	})
+	log.Warnf("CA rotation: %v emergency rotation, skipping update_clients and promoting immediately.", caType)
+	return trace.Wrap(a.rotationPromote(ca))
+}
+
+// RollbackCertAuthority reverts caType out of the update_servers phase,
+// restoring the previously-retired key as the active signer. It only
+// works from update_servers: once standby has dropped the old key there
+// is nothing left to roll back to, and init/update_clients haven't
+// changed the signing key yet so there is nothing to undo.
+func (a *AuthServer) RollbackCertAuthority(caType services.CertAuthType) error {
+	clusterName, err := a.GetClusterName()
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	ca, err := a.GetCertAuthority(services.CertAuthID{
+		DomainName: clusterName.GetClusterName(),
+		Type:       caType,
+	}, true)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	if ca.GetRotationState().Phase != RotationPhaseUpdateServers {
+		return trace.BadParameter("can only roll back CA %v from phase %q, it is in phase %q", caType, RotationPhaseUpdateServers, ca.GetRotationState().Phase)
+	}
+
+	// Promoting swapped the newest key to the front and the old signer
+	// to the back; swapping them back is exactly the inverse.
+	swapFirstAndLast(ca)
+	ca.SetRotationState(CertAuthorityRotationState{
+		Phase:     RotationPhaseUpdateClients,
+		KeyStates: []KeyState{KeyStateSigning, KeyStateStandby},
+	})
+
+	log.Warnf("CA rotation: %v rolled back from update_servers to update_clients, restored previous signing key.", caType)
+	return trace.Wrap(a.Trust.UpsertCertAuthority(ca))
+}
+
+// rotationInit generates a new signing keypair and appends it to ca as a
+// standby key, alongside the existing signing key. Calling it again
+// while already past the init phase is rejected rather than silently
+// appending another standby key.
+func (a *AuthServer) rotationInit(ca services.CertAuthority) error {
+	if state := ca.GetRotationState().Phase; state == RotationPhaseInit {
+		log.Infof("CA rotation: %v already in init, nothing to do.", ca.GetType())
+		return nil
+	} else if state != "" {
+		return trace.BadParameter("CA %v already has a rotation in phase %q in progress", ca.GetType(), state)
+	}
+
+	priv, pub, err := generateCASigningKey(a, nil)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	keyPEM, certPEM, err := tlsca.GenerateSelfSignedCA(pkix.Name{
+		CommonName:   ca.GetClusterName(),
+		Organization: []string{ca.GetClusterName()},
+	}, nil, defaults.CATTL)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	// The existing signing/TLS keys on ca are already wrapped if the
+	// cluster has an unlock key configured; appending priv/keyPEM as-is
+	// would leave the CA with a mix of wrapped and plaintext keys, and
+	// break signing once rotationPromote makes this plaintext key the
+	// active signer.
+	wrapper := a.currentKeyWrapper()
+	wrappedSigningKey, err := wrapSigningKeys(wrapper, [][]byte{priv})
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	wrappedTLSKey, err := wrapSigningKeys(wrapper, [][]byte{keyPEM})
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	ca.SetSigningKeys(append(ca.GetSigningKeys(), wrappedSigningKey[0]))
+	ca.SetCheckingKeys(append(ca.GetCheckingKeys(), pub))
+	ca.SetTLSKeyPairs(append(ca.GetTLSKeyPairs(), services.TLSKeyPair{Cert: certPEM, Key: wrappedTLSKey[0]}))
+	ca.SetRotationState(CertAuthorityRotationState{
+		Phase:     RotationPhaseInit,
+		KeyStates: []KeyState{KeyStateSigning, KeyStateStandby},
+	})
+
+	log.Infof("CA rotation: %v entering init, generated standby key.", ca.GetType())
+	return a.Trust.UpsertCertAuthority(ca)
+}
+
+// rotationPromote makes the newest (standby) key the signing key and
+// demotes the previous signing key to trusted-only. It assumes
+// rotationInit has already appended exactly one standby key. Each call
+// is idempotent: it checks the CA's persisted rotation phase first, so a
+// second update_servers request against an already-promoted CA returns
+// immediately instead of re-reordering (and un-promoting) the keys.
+func (a *AuthServer) rotationPromote(ca services.CertAuthority) error {
+	switch state := ca.GetRotationState().Phase; state {
+	case RotationPhaseUpdateServers:
+		log.Infof("CA rotation: %v already promoted to update_servers, nothing to do.", ca.GetType())
+		return nil
+	case RotationPhaseUpdateClients:
+		// expected predecessor phase, fall through
+	default:
+		return trace.BadParameter("CA %v must complete update_clients before promoting, currently in phase %q", ca.GetType(), state)
+	}
+
+	signingKeys := ca.GetSigningKeys()
+	if len(signingKeys) < 2 {
+		return trace.BadParameter("CA %v has no standby key to promote, run the init phase first", ca.GetType())
+	}
+
+	swapFirstAndLast(ca)
+	ca.SetRotationState(CertAuthorityRotationState{
+		Phase:     RotationPhaseUpdateServers,
+		KeyStates: []KeyState{KeyStateSigning, KeyStateTrustedOnly},
+	})
+
+	log.Infof("CA rotation: %v entering update_servers, new key now signing, old key trusted-only.", ca.GetType())
+	return a.Trust.UpsertCertAuthority(ca)
+}
+
+// swapFirstAndLast moves the newest (last) signing/checking/TLS key pair
+// to the front of each list and the previous front entry to the back,
+// leaving everything else in place. rotationPromote and
+// RollbackCertAuthority are exact inverses of each other via this same
+// swap.
+func swapFirstAndLast(ca services.CertAuthority) {
+	signingKeys := ca.GetSigningKeys()
+	newSigner := signingKeys[len(signingKeys)-1]
+	rest := signingKeys[:len(signingKeys)-1]
+	ca.SetSigningKeys(append([][]byte{newSigner}, rest...))
+
+	checkingKeys := ca.GetCheckingKeys()
+	newChecker := checkingKeys[len(checkingKeys)-1]
+	restCheckers := checkingKeys[:len(checkingKeys)-1]
+	ca.SetCheckingKeys(append([][]byte{newChecker}, restCheckers...))
+
+	tlsKeyPairs := ca.GetTLSKeyPairs()
+	newTLS := tlsKeyPairs[len(tlsKeyPairs)-1]
+	restTLS := tlsKeyPairs[:len(tlsKeyPairs)-1]
+	ca.SetTLSKeyPairs(append([]services.TLSKeyPair{newTLS}, restTLS...))
+}
+
+// rotationRetire drops every key but the current signing key, once the
+// old key's previously issued certificates have all expired. It only
+// runs from update_servers; calling it again once already in standby is
+// a no-op rather than an error, since GetSigningKeys() already has
+// nothing left to trim.
+func (a *AuthServer) rotationRetire(ca services.CertAuthority) error {
+	switch state := ca.GetRotationState().Phase; state {
+	case RotationPhaseStandby:
+		log.Infof("CA rotation: %v already in standby, nothing to do.", ca.GetType())
+		return nil
+	case RotationPhaseUpdateServers:
+		// expected predecessor phase, fall through
+	default:
+		return trace.BadParameter("CA %v must complete update_servers before retiring the old key, currently in phase %q", ca.GetType(), state)
+	}
+
+	signingKeys := ca.GetSigningKeys()
+	checkingKeys := ca.GetCheckingKeys()
+	tlsKeyPairs := ca.GetTLSKeyPairs()
+	if len(signingKeys) == 0 {
+		return trace.BadParameter("CA %v has no signing key", ca.GetType())
+	}
+
+	ca.SetSigningKeys(signingKeys[:1])
+	ca.SetCheckingKeys(checkingKeys[:1])
+	ca.SetTLSKeyPairs(tlsKeyPairs[:1])
+	ca.SetRotationState(CertAuthorityRotationState{
+		Phase:     RotationPhaseStandby,
+		KeyStates: []KeyState{KeyStateSigning},
+	})
+
+	log.Infof("CA rotation: %v entering standby, retired old key.", ca.GetType())
+	return a.Trust.UpsertCertAuthority(ca)
+}
@@ -0,0 +1,98 @@
+/*
+Copyright 2019 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"github.com/gravitational/teleport/lib/services"
+
+	"github.com/gravitational/trace"
+)
+
+// Lock seals the auth server, preventing any further CA signing
+// operations until Unlock is called again with the correct unlock key.
+// It does not affect already-issued certificates.
+func (a *AuthServer) Lock() {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.sealed = true
+	a.caKeyWrapper = nil
+	log.Infof("Auth server sealed: CA signing is disabled until Unlock is called.")
+}
+
+// Unlock verifies key against the configured unlock mechanism and, if it
+// matches, installs the KeyWrapper used to decrypt CA signing keys and
+// resumes normal signing operations. It returns an access denied error
+// if key does not unwrap the CA signing keys already on disk.
+func (a *AuthServer) Unlock(key []byte) error {
+	wrapper, err := NewPassphraseKeyWrapper(key)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	if err := a.verifyUnlockKey(wrapper); err != nil {
+		return trace.Wrap(err)
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.caKeyWrapper = wrapper
+	a.sealed = false
+	log.Infof("Auth server unsealed: CA signing operations resumed.")
+	return nil
+}
+
+// IsSealed returns true if the auth server is currently refusing to sign
+// certificates because it has not been unlocked.
+func (a *AuthServer) IsSealed() bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.sealed
+}
+
+// currentKeyWrapper returns the KeyWrapper installed by the last
+// successful Unlock, or nil if the auth server was never sealed (no
+// unlock key configured) or is currently sealed.
+func (a *AuthServer) currentKeyWrapper() KeyWrapper {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.caKeyWrapper
+}
+
+// verifyUnlockKey checks that wrapper can successfully unwrap the
+// configured host CA signing key, proving the caller supplied the
+// correct unlock key before swapping it in.
+func (a *AuthServer) verifyUnlockKey(wrapper KeyWrapper) error {
+	clusterName, err := a.GetClusterName()
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	hostCA, err := a.GetCertAuthority(services.CertAuthID{
+		DomainName: clusterName.GetClusterName(),
+		Type:       services.HostCA,
+	}, true)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	signingKeys := hostCA.GetSigningKeys()
+	if len(signingKeys) == 0 {
+		// nothing to verify against yet, e.g. first start
+		return nil
+	}
+	if _, err := wrapper.Unwrap(signingKeys[0]); err != nil {
+		return trace.AccessDenied("incorrect unlock key")
+	}
+	return nil
+}
@@ -0,0 +1,270 @@
+/*
+Copyright 2019 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"fmt"
+	"time"
+
+	"github.com/gravitational/teleport/lib/events"
+
+	"github.com/gravitational/trace"
+	"github.com/hashicorp/vault/shamir"
+)
+
+// SealConfig enables Shamir-secret-sharing quorum sealing of CA signing
+// keys. When set on InitConfig, first-start CA generation encrypts the
+// freshly generated RSA private keys with a random master key, splits
+// that master key into Shares parts (any Threshold of which reconstruct
+// it), prints the shares once, and discards the master key from memory.
+// Every subsequent process start comes up sealed until Threshold shares
+// are supplied via AuthServer.Unseal.
+type SealConfig struct {
+	// Threshold is the minimum number of shares required to reconstruct
+	// the master key.
+	Threshold int
+	// Shares is the total number of shares to generate.
+	Shares int
+	// AutoSealAfter, if non-zero, re-seals the auth server this long
+	// after it was last unsealed, forcing operators to re-supply shares
+	// periodically.
+	AutoSealAfter time.Duration
+}
+
+// CheckAndSetDefaults validates the seal configuration.
+func (c *SealConfig) CheckAndSetDefaults() error {
+	if c.Shares < 2 {
+		return trace.BadParameter("Shares: at least 2 shares are required")
+	}
+	if c.Threshold < 2 || c.Threshold > c.Shares {
+		return trace.BadParameter("Threshold: must be between 2 and Shares (%v)", c.Shares)
+	}
+	return nil
+}
+
+const masterKeyLen = 32
+
+// generateMasterKey splits a fresh random master key into cfg.Shares
+// shares and returns both the key and the shares. The caller is
+// responsible for discarding the returned key from memory once it has
+// used it to encrypt CA material.
+func generateMasterKey(cfg *SealConfig) (masterKey []byte, shares [][]byte, err error) {
+	masterKey = make([]byte, masterKeyLen)
+	if _, err := rand.Read(masterKey); err != nil {
+		return nil, nil, trace.Wrap(err)
+	}
+	shares, err = shamir.Split(masterKey, cfg.Shares, cfg.Threshold)
+	if err != nil {
+		return nil, nil, trace.Wrap(err)
+	}
+	return masterKey, shares, nil
+}
+
+// Seal immediately puts the auth server into the sealed state,
+// discarding any reconstructed master key and pending shares from
+// memory. All signing operations are refused until Unseal is called
+// again with a new quorum of shares.
+func (a *AuthServer) Seal() {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.masterKey = nil
+	a.pendingShares = nil
+	a.caKeyWrapper = nil
+	a.sealed = true
+	log.Infof("Auth server sealed: quorum of shares required to resume CA signing.")
+	a.EmitAuditEvent(events.ClusterSealEvent, events.EventFields{
+		events.SealState: "sealed",
+	})
+}
+
+// Unseal accumulates Shamir shares until SealConfig.Threshold of them
+// have been presented, at which point it reconstructs the master key,
+// verifies it actually unwraps the CA signing keys already on disk (a
+// wrong combination of shares reconstructs Threshold-sized garbage just
+// as readily as the real key), and only then transitions the auth
+// server to the unsealed state. It returns the number of shares still
+// needed, or 0 once unsealed.
+func (a *AuthServer) Unseal(share []byte) (sharesNeeded int, err error) {
+	a.lock.Lock()
+	if a.sealMode == nil {
+		a.lock.Unlock()
+		return 0, trace.BadParameter("auth server is not configured for Shamir sealing")
+	}
+	if !a.sealed {
+		a.lock.Unlock()
+		return 0, nil
+	}
+
+	a.pendingShares = append(a.pendingShares, share)
+	if len(a.pendingShares) < a.sealMode.Threshold {
+		needed := a.sealMode.Threshold - len(a.pendingShares)
+		a.lock.Unlock()
+		return needed, nil
+	}
+
+	shares := a.pendingShares
+	a.pendingShares = nil
+	threshold := a.sealMode.Threshold
+	a.lock.Unlock()
+
+	masterKey, err := shamir.Combine(shares)
+	zeroBytes(shares...)
+	if err != nil {
+		return threshold, trace.AccessDenied("failed to reconstruct master key from shares: %v", err)
+	}
+
+	// verifyUnlockKey (shared with the passphrase unlock path in
+	// seal.go) is what actually proves these were the right shares:
+	// shamir.Combine happily returns Threshold-sized garbage for any
+	// wrong combination, so without this check a bad quorum would
+	// silently "unseal" into a master key that can't decrypt anything.
+	wrapper := &masterKeyWrapper{masterKey: masterKey}
+	if err := a.verifyUnlockKey(wrapper); err != nil {
+		return threshold, trace.Wrap(err)
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.masterKey = masterKey
+	a.caKeyWrapper = wrapper
+	a.sealed = false
+
+	log.Infof("Auth server unsealed: quorum of %v shares reconstructed master key.", threshold)
+	a.EmitAuditEvent(events.ClusterSealEvent, events.EventFields{
+		events.SealState: "unsealed",
+	})
+
+	if a.sealMode.AutoSealAfter > 0 {
+		go a.autoSealAfter(a.sealMode.AutoSealAfter)
+	}
+
+	return 0, nil
+}
+
+// RekeySeal re-splits the current master key under a new threshold/share
+// count and returns the newly generated shares. The auth server must
+// already be unsealed. The master key itself is unchanged, so a quorum
+// of shares issued under the old split still reconstructs it; only the
+// number of shares Unseal waits for changes.
+func (a *AuthServer) RekeySeal(newThreshold, newShares int) ([][]byte, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.sealed || len(a.masterKey) == 0 {
+		return nil, trace.BadParameter("auth server must be unsealed to rekey the seal")
+	}
+	newCfg := &SealConfig{Threshold: newThreshold, Shares: newShares}
+	if err := newCfg.CheckAndSetDefaults(); err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	shares, err := shamir.Split(a.masterKey, newCfg.Shares, newCfg.Threshold)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	a.sealMode = newCfg
+
+	log.Infof("Auth server seal rekeyed: now %v-of-%v.", newCfg.Threshold, newCfg.Shares)
+	a.EmitAuditEvent(events.ClusterSealEvent, events.EventFields{
+		events.SealState: "rekeyed",
+	})
+	return shares, nil
+}
+
+// autoSealAfter seals the auth server after d has elapsed, unless it has
+// already been sealed manually in the meantime.
+func (a *AuthServer) autoSealAfter(d time.Duration) {
+	time.Sleep(d)
+	if a.IsSealed() {
+		return
+	}
+	log.Infof("Auto-seal timer expired, sealing auth server.")
+	a.Seal()
+}
+
+// masterKeyWrapper is a KeyWrapper that wraps CA signing keys directly
+// with a Shamir-split master key, rather than a key derived from a
+// passphrase via PBKDF2 (see passphraseKeyWrapper).
+type masterKeyWrapper struct {
+	masterKey []byte
+}
+
+// Wrap implements KeyWrapper.
+func (m *masterKeyWrapper) Wrap(plaintext []byte) ([]byte, error) {
+	gcm, err := m.newGCM()
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	sealed := gcm.Seal(nil, nonce, plaintext, nil)
+	return append(nonce, sealed...), nil
+}
+
+// Unwrap implements KeyWrapper.
+func (m *masterKeyWrapper) Unwrap(ciphertext []byte) ([]byte, error) {
+	gcm, err := m.newGCM()
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	nonceSize := gcm.NonceSize()
+	if len(ciphertext) < nonceSize {
+		return nil, trace.BadParameter("ciphertext too short to contain nonce")
+	}
+	nonce, sealed := ciphertext[:nonceSize], ciphertext[nonceSize:]
+	plaintext, err := gcm.Open(nil, nonce, sealed, nil)
+	if err != nil {
+		return nil, trace.AccessDenied("failed to unwrap key with reconstructed master key")
+	}
+	return plaintext, nil
+}
+
+func (m *masterKeyWrapper) newGCM() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(m.masterKey)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// zeroBytes overwrites each of bufs with zeroes in place, used to scrub
+// raw Shamir shares from memory once they've been combined into (or
+// failed to combine into) the master key.
+func zeroBytes(bufs ...[]byte) {
+	for _, buf := range bufs {
+		for i := range buf {
+			buf[i] = 0
+		}
+	}
+}
+
+// printSealShares prints newly generated Shamir shares to the operator
+// exactly once. Shares are never written to disk or logged at a level
+// that would end up in the audit log.
+func printSealShares(shares [][]byte, threshold int) {
+	fmt.Println("Cluster CA keys are now sealed. Distribute the following shares to")
+	fmt.Printf("separate operators; any %v of them will be able to unseal this cluster:\n\n", threshold)
+	for i, share := range shares {
+		fmt.Printf("  Share %d: %x\n", i+1, share)
+	}
+	fmt.Println()
+}
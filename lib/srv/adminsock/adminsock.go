@@ -0,0 +1,181 @@
+/*
+Copyright 2019 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package adminsock implements a local Unix-domain socket speaking a
+// small line-delimited JSON protocol for operator tooling, modeled on
+// the local admin RPC socket pattern used by other Go control-plane
+// daemons (one JSON object per line in, one JSON object per line out,
+// no framing beyond the newline). It carries no authentication of its
+// own: access control is the socket file's mode and the directory
+// it lives in, exactly like dockerd's or containerd's control sockets.
+package adminsock
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"os"
+	"sync"
+
+	"github.com/gravitational/trace"
+)
+
+// SocketMode is the permission bits the socket file is created with:
+// owner read/write only, since anyone who can dial it can invoke any
+// registered verb.
+const SocketMode = 0600
+
+// Request is a single line of the adminsock protocol sent by a client.
+type Request struct {
+	// Verb selects the registered Handler to invoke, e.g.
+	// "list-oidc-users".
+	Verb string `json:"verb"`
+	// Args are passed to the Handler verbatim.
+	Args []string `json:"args,omitempty"`
+}
+
+// Response is a single line of the adminsock protocol sent back to a
+// client in reply to a Request.
+type Response struct {
+	// OK is false if Handler returned an error; Error then holds its
+	// message.
+	OK bool `json:"ok"`
+	// Result is the Handler's return value, omitted on error.
+	Result interface{} `json:"result,omitempty"`
+	// Error is set when OK is false.
+	Error string `json:"error,omitempty"`
+}
+
+// Handler implements one verb of the adminsock protocol.
+type Handler func(args []string) (interface{}, error)
+
+// Registry maps verbs to the Handler that serves them. It exists
+// separately from Server so subsystems other than the one that opens
+// the socket (session recorder, cert authority, ...) can register their
+// own verbs on it before the socket is started.
+type Registry struct {
+	mu       sync.Mutex
+	handlers map[string]Handler
+}
+
+// NewRegistry returns an empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{handlers: make(map[string]Handler)}
+}
+
+// Register adds h under verb, replacing any previously registered
+// Handler for the same verb.
+func (r *Registry) Register(verb string, h Handler) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.handlers[verb] = h
+}
+
+// dispatch looks up and invokes the Handler for verb.
+func (r *Registry) dispatch(verb string, args []string) (interface{}, error) {
+	r.mu.Lock()
+	h, ok := r.handlers[verb]
+	r.mu.Unlock()
+	if !ok {
+		return nil, trace.BadParameter("unknown adminsock verb %q", verb)
+	}
+	return h(args)
+}
+
+// Server listens on a Unix-domain socket and dispatches each incoming
+// line to registry.
+type Server struct {
+	path     string
+	registry *Registry
+	listener net.Listener
+}
+
+// New creates the Unix-domain socket at path, removing any stale socket
+// file left behind by a previous, uncleanly-terminated process first.
+// The socket is created with SocketMode regardless of the process
+// umask.
+func New(path string, registry *Registry) (*Server, error) {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, trace.ConvertSystemError(err)
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, trace.ConvertSystemError(err)
+	}
+	if err := os.Chmod(path, SocketMode); err != nil {
+		listener.Close()
+		return nil, trace.ConvertSystemError(err)
+	}
+
+	return &Server{path: path, registry: registry, listener: listener}, nil
+}
+
+// Serve accepts connections until the listener is closed, handling each
+// one in its own goroutine. It returns nil when Close stops the
+// listener, and any other error encountered accepting a connection.
+func (s *Server) Serve() error {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			if isClosedError(err) {
+				return nil
+			}
+			return trace.Wrap(err)
+		}
+		go s.handleConn(conn)
+	}
+}
+
+// Close stops accepting new connections and removes the socket file.
+func (s *Server) Close() error {
+	err := s.listener.Close()
+	os.Remove(s.path)
+	return trace.Wrap(err)
+}
+
+// handleConn reads one Request per line from conn, dispatches it, and
+// writes back one Response per line, until conn is closed. A line that
+// fails to parse as JSON gets an error Response and the connection stays
+// open.
+func (s *Server) handleConn(conn net.Conn) {
+	defer conn.Close()
+
+	scanner := bufio.NewScanner(conn)
+	encoder := json.NewEncoder(conn)
+	for scanner.Scan() {
+		var req Request
+		if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+			encoder.Encode(Response{Error: trace.BadParameter("malformed request: %v", err).Error()})
+			continue
+		}
+
+		result, err := s.registry.dispatch(req.Verb, req.Args)
+		if err != nil {
+			encoder.Encode(Response{Error: err.Error()})
+			continue
+		}
+		encoder.Encode(Response{OK: true, Result: result})
+	}
+}
+
+// isClosedError reports whether err is the "use of closed network
+// connection" error Accept returns after Close, which Serve treats as a
+// clean shutdown rather than a failure.
+func isClosedError(err error) bool {
+	opErr, ok := err.(*net.OpError)
+	return ok && opErr.Err.Error() == "use of closed network connection"
+}
@@ -0,0 +1,308 @@
+/*
+Copyright 2019 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package srv
+
+import (
+	"io"
+	"os"
+	"os/exec"
+	"syscall"
+
+	"github.com/gravitational/trace"
+	"github.com/kr/pty"
+)
+
+// PTYSize is the terminal dimensions a PTY-backed Process's window starts
+// at (and is later resized to via Process.Resize), mirroring the SSH
+// "pty-req"/"window-change" request parameters.
+type PTYSize struct {
+	Rows int
+	Cols int
+}
+
+// RuntimeNative is the name of the default SessionRuntime: forking argv
+// directly under the mapped Unix user, exactly as prepareCommand /
+// prepareInteractiveCommand have always done.
+const RuntimeNative = "native"
+
+// ExecResult is the outcome of a Process that has run to completion: the
+// command that was run and the numeric exit code it returned, or -1 if
+// it was killed by a signal or never started. exec.go (not present in
+// this checkout; see the NOTE on SessionRuntime below) is what would
+// translate this into the SSH "exit-status"/"exit-signal" request sent
+// back to the client.
+type ExecResult struct {
+	Command string
+	Code    int
+}
+
+// Process is the runtime-agnostic handle Spawn returns. localExec and
+// remoteExec drive a session entirely through this interface, so neither
+// needs to know whether it ended up talking to a forked child process or
+// a container managed by a containerd shim.
+type Process interface {
+	// Stdin returns the process's standard input.
+	Stdin() io.WriteCloser
+	// Stdout returns the process's standard output.
+	Stdout() io.Reader
+	// Stderr returns the process's standard error. It is nil when the
+	// process is attached to a PTY, matching os/exec.Cmd's behavior.
+	Stderr() io.Reader
+	// PID returns the OS process ID of the running process; for
+	// container-backed runtimes, that of the container's init process as
+	// seen from the host PID namespace.
+	PID() int
+	// Signal forwards an OS signal to the process, used to propagate
+	// SIGTERM/SIGKILL on session termination.
+	Signal(sig os.Signal) error
+	// Resize changes the window size of the process's PTY in response to
+	// an SSH "window-change" request. It returns an error for a Process
+	// that was spawned without a PTY (see SessionRuntime.Spawn).
+	Resize(rows, cols int) error
+	// Wait blocks until the process exits and returns its result.
+	Wait() (*ExecResult, error)
+}
+
+// SessionRuntime spawns the command backing an interactive or exec SSH
+// session. The default nativeRuntime forks argv directly; other
+// implementations (e.g. containerdShimRuntime) run it inside a sandbox
+// instead.
+//
+// NOTE: prepareCommand/localExec/remoteExec (exec.go) and ServerContext
+// (ctx.go) are what would actually resolve a SessionRuntime via
+// ResolveRuntime and call Spawn instead of forking argv directly; neither
+// file exists in this checkout, so nothing in this package is reachable
+// from a live SSH session yet. nativeRuntime and containerdShimRuntime
+// are otherwise complete (PTY allocation, env, signal forwarding, resize,
+// Wait all implemented below and in runtime_containerd.go) and ready to
+// be called from that integration once it lands.
+type SessionRuntime interface {
+	// Name identifies this SessionRuntime, e.g. "native" or
+	// "containerd:io.containerd.kata.v2".
+	Name() string
+	// Spawn starts argv with env set in its environment and returns a
+	// handle to the running process. ptySize is non-nil for an
+	// interactive session (localExec/remoteExec's "pty-req" path) and
+	// nil for a one-shot exec request; implementations allocate a PTY and
+	// attach argv to it only in the former case. SSH_TELEPORT_*
+	// environment injection, signal forwarding, and exit status handling
+	// go through the returned Process, so env must already contain
+	// everything the session needs; Spawn itself makes no assumptions
+	// about what's in it.
+	Spawn(ctx *ServerContext, argv []string, env []string, ptySize *PTYSize) (Process, error)
+}
+
+// nativeRuntime is the SessionRuntime backing today's behavior: argv is
+// forked directly via os/exec under the identity ServerContext has
+// already assumed (setuid/setgid, working directory, etc. are baked into
+// argv/env by prepareCommand / prepareInteractiveCommand before Spawn is
+// ever called).
+type nativeRuntime struct{}
+
+// NewNativeRuntime returns the default SessionRuntime.
+func NewNativeRuntime() SessionRuntime {
+	return &nativeRuntime{}
+}
+
+// Name implements SessionRuntime.
+func (r *nativeRuntime) Name() string { return RuntimeNative }
+
+// Spawn implements SessionRuntime by starting argv as a plain child
+// process. With ptySize nil (a one-shot exec request), it is wired to
+// stdio pipes exactly as before. With ptySize set (an interactive
+// session), argv is attached to a kr/pty-opened master/slave pair
+// instead: os/exec's Stdin/Stdout/StderrPipe can only be taken once, and
+// only before Start, so PTY assignment has to happen at this same
+// construction step rather than lazily on first Process access.
+func (r *nativeRuntime) Spawn(ctx *ServerContext, argv []string, env []string, ptySize *PTYSize) (Process, error) {
+	if len(argv) == 0 {
+		return nil, trace.BadParameter("argv: at least one argument (the program) is required")
+	}
+	cmd := exec.Command(argv[0], argv[1:]...)
+	cmd.Env = env
+
+	if ptySize == nil {
+		stdin, err := cmd.StdinPipe()
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+		stderr, err := cmd.StderrPipe()
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+		if err := cmd.Start(); err != nil {
+			return nil, trace.Wrap(err)
+		}
+		return &nativeProcess{cmd: cmd, stdin: stdin, stdout: stdout, stderr: stderr}, nil
+	}
+
+	master, tty, err := pty.Open()
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	defer tty.Close()
+	if err := pty.Setsize(master, &pty.Winsize{Rows: uint16(ptySize.Rows), Cols: uint16(ptySize.Cols)}); err != nil {
+		master.Close()
+		return nil, trace.Wrap(err)
+	}
+
+	cmd.Stdin = tty
+	cmd.Stdout = tty
+	cmd.Stderr = tty
+	// Setsid+Setctty make the slave the controlling terminal of the new
+	// session, which is what lets the child (and anything it execs, like
+	// a login shell) receive SIGWINCH/SIGHUP the way an interactive
+	// terminal session expects.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true, Setctty: true}
+
+	if err := cmd.Start(); err != nil {
+		master.Close()
+		return nil, trace.Wrap(err)
+	}
+
+	return &nativeProcess{cmd: cmd, pty: master}, nil
+}
+
+// nativeProcess adapts an *exec.Cmd to the Process interface. For a
+// pipe-backed (non-PTY) process, stdin/stdout/stderr are taken once in
+// Spawn, before the process starts, since os/exec only allows each pipe
+// to be taken once. For a PTY-backed process, pty is the master end and
+// serves as both Stdin and Stdout; Stderr is nil, matching a PTY's single
+// combined stream.
+type nativeProcess struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout io.Reader
+	stderr io.Reader
+	pty    *os.File
+}
+
+// Stdin implements Process.
+func (p *nativeProcess) Stdin() io.WriteCloser {
+	if p.pty != nil {
+		return p.pty
+	}
+	return p.stdin
+}
+
+// Stdout implements Process.
+func (p *nativeProcess) Stdout() io.Reader {
+	if p.pty != nil {
+		return p.pty
+	}
+	return p.stdout
+}
+
+// Stderr implements Process.
+func (p *nativeProcess) Stderr() io.Reader {
+	if p.pty != nil {
+		return nil
+	}
+	return p.stderr
+}
+
+// PID implements Process. It returns 0 until the process has been
+// started.
+func (p *nativeProcess) PID() int {
+	if p.cmd.Process == nil {
+		return 0
+	}
+	return p.cmd.Process.Pid
+}
+
+// Signal implements Process.
+func (p *nativeProcess) Signal(sig os.Signal) error {
+	if p.cmd.Process == nil {
+		return trace.BadParameter("process has not been started")
+	}
+	return trace.Wrap(p.cmd.Process.Signal(sig))
+}
+
+// Resize implements Process.
+func (p *nativeProcess) Resize(rows, cols int) error {
+	if p.pty == nil {
+		return trace.BadParameter("process has no PTY to resize")
+	}
+	return trace.Wrap(pty.Setsize(p.pty, &pty.Winsize{Rows: uint16(rows), Cols: uint16(cols)}))
+}
+
+// Wait implements Process.
+func (p *nativeProcess) Wait() (*ExecResult, error) {
+	err := p.cmd.Wait()
+	if p.pty != nil {
+		p.pty.Close()
+	}
+	return &ExecResult{
+		Command: p.cmd.Path,
+		Code:    exitCode(p.cmd, err),
+	}, trace.Wrap(err)
+}
+
+// exitCode extracts the numeric exit status from cmd once it has
+// finished, or -1 if it was killed by a signal or never ran.
+func exitCode(cmd *exec.Cmd, waitErr error) int {
+	if cmd.ProcessState == nil {
+		return -1
+	}
+	return cmd.ProcessState.ExitCode()
+}
+
+// RuntimeConfig selects which SessionRuntime a node uses by default, and
+// which named overrides are available to steer specific roles into a
+// different one (e.g. a group of users mapped by ClaimsToRoles into a
+// "kata" role gets a Kata Containers sandbox while everyone else stays on
+// runc). Overrides are keyed by role name rather than expressed as a new
+// field on services.Role, so enabling this needs no change to the role
+// resource schema, only to a node's static config and its role mapping.
+type RuntimeConfig struct {
+	// Default is the runtime used for roles with no entry in Overrides.
+	// Empty means RuntimeNative.
+	Default string
+	// Overrides maps a role name to the runtime it should use.
+	Overrides map[string]string
+}
+
+// ResolveRuntime picks the SessionRuntime for roles out of the runtimes
+// registered in registry, applying cfg's per-role overrides in role-set
+// order and falling back to cfg.Default (or RuntimeNative) if none match.
+func ResolveRuntime(registry map[string]SessionRuntime, cfg RuntimeConfig, roles []string) (SessionRuntime, error) {
+	for _, role := range roles {
+		name, ok := cfg.Overrides[role]
+		if !ok {
+			continue
+		}
+		runtime, ok := registry[name]
+		if !ok {
+			return nil, trace.BadParameter("role %q selects unknown session runtime %q", role, name)
+		}
+		return runtime, nil
+	}
+
+	name := cfg.Default
+	if name == "" {
+		name = RuntimeNative
+	}
+	runtime, ok := registry[name]
+	if !ok {
+		return nil, trace.BadParameter("unknown default session runtime %q", name)
+	}
+	return runtime, nil
+}